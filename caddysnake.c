@@ -1,85 +1,248 @@
 #include "caddysnake.h"
 #include <Python.h>
+#include <stdatomic.h>
 #include <stdio.h>
 #include <string.h>
+#include <time.h>
+#include <unistd.h>
 
-#if PY_MAJOR_VERSION != 3 || PY_MINOR_VERSION < 9 || PY_MINOR_VERSION > 12
-#error "This code requires Python 3.9, 3.10, 3.11 or 3.12"
+#if PY_MAJOR_VERSION != 3 || PY_MINOR_VERSION < 9 || PY_MINOR_VERSION > 13
+#error "This code requires Python 3.9, 3.10, 3.11, 3.12 or 3.13"
 #endif
 
+// Fields shared between threads are guarded by critical sections, which lock
+// the object on free-threaded builds and are a no-op when there's a GIL.
+// They were introduced in Python 3.13.
+#ifndef Py_BEGIN_CRITICAL_SECTION
+#define Py_BEGIN_CRITICAL_SECTION(op) {
+#define Py_END_CRITICAL_SECTION() }
+#endif
+
+/*
+TimedGil acquires the GIL for a call from Go and measures how long it waited
+for it and how long the call held it. The times are reported to Go on release,
+so users can tell whether requests are slowed down by the GIL or by Python.
+*/
+typedef struct {
+  const char *call;
+  PyGILState_STATE state;
+  int64_t start_ns;
+  int64_t acquired_ns;
+} TimedGil;
+
+static int64_t Monotonic_ns(void) {
+  struct timespec ts;
+  clock_gettime(CLOCK_MONOTONIC, &ts);
+  return (int64_t)ts.tv_sec * 1000000000 + ts.tv_nsec;
+}
+
+static void TimedGil_ensure(TimedGil *gil, const char *call) {
+  gil->call = call;
+  gil->start_ns = Monotonic_ns();
+  gil->state = PyGILState_Ensure();
+  gil->acquired_ns = Monotonic_ns();
+}
+
+static void TimedGil_release(TimedGil *gil) {
+  int64_t released_ns = Monotonic_ns();
+  PyGILState_Release(gil->state);
+  python_call_timing((char *)gil->call, gil->acquired_ns - gil->start_ns,
+                     released_ns - gil->acquired_ns);
+}
+
 struct WsgiApp {
+  // Replaced on reload, see App_get_handler
   PyObject *handler;
+  PyThread_type_lock handler_lock;
 };
 
 // WSGI: global variables
 static PyObject *wsgi_version;
-static PyObject *sys_stderr;
-static PyObject *BytesIO;
+static PyObject *is_asgi_app;
+static PyObject *read_project_config;
+static PyObject *reload_app;
+static PyObject *dump_stacks;
+static PyObject *memory_profile;
+static PyObject *health_check;
+static PyObject *shell;
+static PyObject *current_request_id;
+static PyObject *log_writer;
+static PyObject *format_exception;
 static PyObject *task_queue_put;
+static PyObject *build_wsgi_input;
+static PyObject *wsgi_file_wrapper;
+static PyObject *wsgi_start_threads;
+// Requests put in the task queue that no thread has picked up yet
+static atomic_long wsgi_queued;
 
 // ASGI: global variables
 static PyObject *asgi_version;
+static PyObject *asgi_extensions;
 static PyObject *asyncio_Event_ts;
-static PyObject *asyncio_Loop;
+// Set once by the first app, read by requests and by Py_dump_stacks
+static _Atomic(PyObject *) asyncio_Loop;
 static PyObject *asyncio_run_coroutine_threadsafe;
 static PyObject *build_receive;
 static PyObject *build_send;
 static PyObject *build_lifespan;
+static PyObject *start_event_loop;
+static PyObject *set_executor_threads;
 
-char *concatenate_strings(const char *str1, const char *str2) {
-  size_t new_str_len = strlen(str1) + strlen(str2) + 1;
-  char *result = malloc(new_str_len * sizeof(char));
-  if (result == NULL) {
-    return NULL;
-  }
-  strcpy(result, str1);
-  strcat(result, str2);
+/*
+App_get_handler returns a new reference to the app handler. Handlers can be
+replaced on reload while requests are running in other threads, so they're
+only accessed holding lock.
+*/
+static PyObject *App_get_handler(PyObject **handler, PyThread_type_lock lock) {
+  PyThread_acquire_lock(lock, WAIT_LOCK);
+  PyObject *result = *handler;
+  Py_INCREF(result);
+  PyThread_release_lock(lock);
   return result;
 }
 
-char *copy_pystring(PyObject *pystr) {
-  Py_ssize_t og_size = 0;
-  const char *og_str = PyUnicode_AsUTF8AndSize(pystr, &og_size);
-  size_t new_str_len = og_size + 1;
-  char *result = malloc(new_str_len * sizeof(char));
-  if (result == NULL) {
+/*
+App_set_handler replaces the app handler, stealing the new_handler reference.
+*/
+static void App_set_handler(PyObject **handler, PyThread_type_lock lock,
+                            PyObject *new_handler) {
+  PyThread_acquire_lock(lock, WAIT_LOCK);
+  PyObject *previous = *handler;
+  *handler = new_handler;
+  PyThread_release_lock(lock);
+  Py_DECREF(previous);
+}
+
+/*
+MapKeyVal_new allocates a map with room for count pairs and data_size bytes of
+keys and values, including their NUL terminators. Everything lives in a single
+block of memory that's released with MapKeyVal_free.
+*/
+MapKeyVal *MapKeyVal_new(size_t count, size_t data_size) {
+  MapKeyVal *new_map = (MapKeyVal *)malloc(
+      sizeof(MapKeyVal) + 2 * count * sizeof(char *) + data_size);
+  if (new_map == NULL) {
     return NULL;
   }
-  strcpy(result, og_str);
-  return result;
+  new_map->count = count;
+  new_map->keys = (char **)(new_map + 1);
+  new_map->values = new_map->keys + count;
+  new_map->data = (char *)(new_map->values + count);
+  new_map->data_size = data_size;
+  new_map->data_used = 0;
+  return new_map;
+}
+
+static char *MapKeyVal_copy(MapKeyVal *map, const char *str, size_t len) {
+  char *dest = map->data + map->data_used;
+  memcpy(dest, str, len);
+  dest[len] = '\0';
+  map->data_used += len + 1;
+  return dest;
+}
+
+/*
+MapKeyVal_set copies a key and a value into the data of the map.
+*/
+void MapKeyVal_set(MapKeyVal *map, size_t pos, const char *key, size_t key_len,
+                   const char *value, size_t value_len) {
+  map->keys[pos] = MapKeyVal_copy(map, key, key_len);
+  map->values[pos] = MapKeyVal_copy(map, value, value_len);
+}
+
+/*
+Pyobject_as_string returns the contents of a str (encoded as UTF-8) or of a
+bytes object when bytes is set. Returns -1 with an exception set otherwise.
+*/
+static int Pyobject_as_string(PyObject *obj, int bytes, const char **str,
+                              Py_ssize_t *len) {
+  if (bytes) {
+    if (!PyBytes_Check(obj)) {
+      PyErr_SetString(PyExc_TypeError, "expected bytes");
+      return -1;
+    }
+    *str = PyBytes_AS_STRING(obj);
+    *len = PyBytes_GET_SIZE(obj);
+    return 0;
+  }
+  if (!PyUnicode_Check(obj)) {
+    PyErr_SetString(PyExc_TypeError, "expected str");
+    return -1;
+  }
+  *str = PyUnicode_AsUTF8AndSize(obj, len);
+  return *str ? 0 : -1;
 }
 
-char *copy_pybytes(PyObject *pybytes) {
-  Py_ssize_t og_size = 0;
-  char *og_str;
-  if (PyBytes_AsStringAndSize(pybytes, &og_str, &og_size) < 0) {
+/*
+MapKeyVal_from_pairs copies a sequence of (key, value) pairs, made of str or
+bytes, into a MapKeyVal. The size of the data is computed first so it's
+allocated at once. Returns NULL with an exception set if the pairs are
+invalid, the exception message is error.
+*/
+static MapKeyVal *MapKeyVal_from_pairs(PyObject *pairs, int bytes,
+                                       const char *error) {
+  PyObject *pairs_seq = PySequence_Fast(pairs, error);
+  if (!pairs_seq) {
     return NULL;
   }
-  size_t new_str_len = og_size + 1;
-  char *result = malloc(new_str_len * sizeof(char));
-  if (result == NULL) {
+  Py_ssize_t count = PySequence_Fast_GET_SIZE(pairs_seq);
+  size_t data_size = 0;
+  for (Py_ssize_t pos = 0; pos < count; pos++) {
+    PyObject *item = PySequence_Fast_GET_ITEM(pairs_seq, pos);
+    const char *str;
+    Py_ssize_t len;
+    if (!PyTuple_Check(item) && !PyList_Check(item)) {
+      goto invalid;
+    }
+    if (PySequence_Fast_GET_SIZE(item) != 2) {
+      goto invalid;
+    }
+    for (Py_ssize_t i = 0; i < 2; i++) {
+      if (Pyobject_as_string(PySequence_Fast_GET_ITEM(item, i), bytes, &str,
+                             &len) < 0) {
+        goto invalid;
+      }
+      data_size += len + 1;
+    }
+  }
+
+  MapKeyVal *map = MapKeyVal_new(count, data_size);
+  if (!map) {
+    Py_DECREF(pairs_seq);
+    PyErr_NoMemory();
     return NULL;
   }
-  strcpy(result, og_str);
-  return result;
-}
+  for (Py_ssize_t pos = 0; pos < count; pos++) {
+    PyObject *item = PySequence_Fast_GET_ITEM(pairs_seq, pos);
+    const char *key, *value;
+    Py_ssize_t key_len, value_len;
+    Pyobject_as_string(PySequence_Fast_GET_ITEM(item, 0), bytes, &key,
+                       &key_len);
+    Pyobject_as_string(PySequence_Fast_GET_ITEM(item, 1), bytes, &value,
+                       &value_len);
+    MapKeyVal_set(map, pos, key, key_len, value, value_len);
+  }
+  Py_DECREF(pairs_seq);
+  return map;
 
-MapKeyVal *MapKeyVal_new(size_t count) {
-  MapKeyVal *new_map = (MapKeyVal *)malloc(sizeof(MapKeyVal));
-  new_map->count = count;
-  new_map->keys = malloc(sizeof(char *) * count);
-  new_map->values = malloc(sizeof(char *) * count);
-  return new_map;
+invalid:
+  Py_DECREF(pairs_seq);
+  PyErr_SetString(PyExc_RuntimeError, error);
+  return NULL;
 }
 
-typedef struct {
+struct RequestResponse {
   PyObject_HEAD WsgiApp *app;
   int64_t request_id;
   PyObject *request_environ;
   PyObject *response_headers;
   PyObject *response_body;
   int response_status;
-} RequestResponse;
+  unsigned long thread_id;
+  uint8_t cancelled;
+  // Name of the thread of the pool running the request
+  char worker[64];
+};
 
 static void Debug_obj(PyObject *obj) {
   PyObject *repr = PyObject_Repr(obj);
@@ -97,6 +260,9 @@ static PyObject *Response_new(PyTypeObject *type, PyObject *args,
     self->response_headers = NULL;
     self->response_body = NULL;
     self->response_status = 500;
+    self->thread_id = 0;
+    self->cancelled = 0;
+    self->worker[0] = '\0';
   }
   return (PyObject *)self;
 }
@@ -155,15 +321,44 @@ static PyObject *Response_start(RequestResponse *self, PyObject *args) {
 }
 
 static PyObject *Response_call_wsgi(RequestResponse *self, PyObject *args) {
+  atomic_fetch_sub(&wsgi_queued, 1);
+  const char *worker = "";
+  if (!PyArg_ParseTuple(args, "|s", &worker)) {
+    return NULL;
+  }
+  // Keep track of the thread so the request can be cancelled on timeout
+  int cancelled;
+  Py_BEGIN_CRITICAL_SECTION(self);
+  cancelled = self->cancelled;
+  if (!cancelled) {
+    self->thread_id = PyThread_get_thread_ident();
+    snprintf(self->worker, sizeof(self->worker), "%s", worker);
+  }
+  Py_END_CRITICAL_SECTION();
+  if (cancelled) {
+    PyErr_SetString(PyExc_TimeoutError, "request timed out");
+    return NULL;
+  }
+  // Anything written to sys.stderr from this thread is logged with the
+  // request id
+  PyObject *py_request_id = PyLong_FromLongLong(self->request_id);
+  Py_XDECREF(PyContextVar_Set(current_request_id, py_request_id));
+  Py_DECREF(py_request_id);
   PyObject *start_response_fn =
       PyObject_GetAttrString((PyObject *)self, "start_response");
   PyObject *new_args = PyTuple_New(2);
   PyTuple_SetItem(new_args, 0, self->request_environ);
   PyTuple_SetItem(new_args, 1, start_response_fn);
-  self->response_body = PyObject_Call(self->app->handler, new_args, NULL);
+  PyObject *handler =
+      App_get_handler(&self->app->handler, self->app->handler_lock);
+  self->response_body = PyObject_Call(handler, new_args, NULL);
+  Py_DECREF(handler);
   Py_INCREF(self->request_environ);
   Py_DECREF(new_args);
-  return (PyObject *)self;
+  if (!self->response_body) {
+    return NULL;
+  }
+  Py_RETURN_NONE;
 }
 
 static PyMethodDef Response_methods[] = {
@@ -186,50 +381,125 @@ static PyTypeObject ResponseType = {
     .tp_methods = Response_methods,
 };
 
-WsgiApp *WsgiApp_import(const char *module_name, const char *app_name,
-                        const char *venv_path) {
-  WsgiApp *app = malloc(sizeof(WsgiApp));
-  if (app == NULL) {
-    return NULL;
-  }
-  PyGILState_STATE gstate = PyGILState_Ensure();
-
+/*
+Py_import_app imports module_name and returns its app_name attribute, which must
+be callable. venv_path is added to sys.path when it's not already there.
+Returns NULL if the app can't be imported, the error is printed. Must be called
+with the GIL held.
+*/
+static PyObject *Py_import_app(const char *module_name, const char *app_name,
+                               const char *venv_path) {
   // Add venv_path into sys.path list
   if (venv_path) {
     PyObject *sysPath = PySys_GetObject("path");
-    PyList_Append(sysPath, PyUnicode_FromString(venv_path));
+    PyObject *path = PyUnicode_FromString(venv_path);
+    if (PySequence_Contains(sysPath, path) == 0) {
+      PyList_Append(sysPath, path);
+    }
+    Py_DECREF(path);
   }
 
   PyObject *module = PyImport_ImportModule(module_name);
   if (module == NULL) {
     PyErr_Print();
-    PyGILState_Release(gstate);
     return NULL;
   }
 
-  app->handler = PyObject_GetAttrString(module, app_name);
-  if (!app->handler || !PyCallable_Check(app->handler)) {
+  PyObject *handler = PyObject_GetAttrString(module, app_name);
+  Py_DECREF(module);
+  if (!handler || !PyCallable_Check(handler)) {
     if (PyErr_Occurred()) {
       PyErr_Print();
     }
+    Py_XDECREF(handler);
+    return NULL;
+  }
+  return handler;
+}
+
+/*
+Py_reload_app imports the app again, see reload_app in caddysnake.py. Returns
+NULL if it fails, the error is printed. Must be called with the GIL held.
+*/
+static PyObject *Py_reload_app(const char *module_name, const char *app_name) {
+  PyObject *handler =
+      PyObject_CallFunction(reload_app, "ss", module_name, app_name);
+  if (!handler) {
+    PyErr_Print();
+  }
+  return handler;
+}
+
+/*
+Py_detect_interface imports the app and returns 1 if it's an ASGI app, 0 if
+it's a WSGI app and -1 if it can't be imported.
+*/
+int Py_detect_interface(const char *module_name, const char *app_name,
+                        const char *venv_path) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  int result = -1;
+  PyObject *handler = Py_import_app(module_name, app_name, venv_path);
+  if (handler) {
+    PyObject *asgi = PyObject_CallOneArg(is_asgi_app, handler);
+    if (asgi) {
+      result = PyObject_IsTrue(asgi);
+      Py_DECREF(asgi);
+    } else {
+      PyErr_Print();
+    }
+    Py_DECREF(handler);
+  }
+  PyGILState_Release(gstate);
+  return result;
+}
+
+WsgiApp *WsgiApp_import(const char *module_name, const char *app_name,
+                        const char *venv_path) {
+  WsgiApp *app = malloc(sizeof(WsgiApp));
+  if (app == NULL) {
+    return NULL;
+  }
+  PyGILState_STATE gstate = PyGILState_Ensure();
+
+  app->handler = Py_import_app(module_name, app_name, venv_path);
+  if (!app->handler) {
     PyGILState_Release(gstate);
+    free(app);
     return NULL;
   }
+  app->handler_lock = PyThread_allocate_lock();
 
   PyGILState_Release(gstate);
   return app;
 }
 
+/*
+WsgiApp_reload imports the app again. Running requests finish with the
+previous app. Returns 0 if it fails, then the previous app is kept.
+*/
+int WsgiApp_reload(WsgiApp *app, const char *module_name,
+                   const char *app_name) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  PyObject *handler = Py_reload_app(module_name, app_name);
+  if (handler) {
+    App_set_handler(&app->handler, app->handler_lock, handler);
+  }
+  PyGILState_Release(gstate);
+  return handler != NULL;
+}
+
 void WsgiApp_cleanup(WsgiApp *app) {
   PyGILState_STATE gstate = PyGILState_Ensure();
   Py_XDECREF(app->handler);
   PyGILState_Release(gstate);
+  PyThread_free_lock(app->handler_lock);
   free(app);
 }
 
-void WsgiApp_handle_request(WsgiApp *app, int64_t request_id,
-                            MapKeyVal *headers, const char *body) {
-  PyGILState_STATE gstate = PyGILState_Ensure();
+RequestResponse *WsgiApp_handle_request(WsgiApp *app, int64_t request_id,
+                                        MapKeyVal *headers) {
+  TimedGil gil;
+  TimedGil_ensure(&gil, "wsgi");
 
   PyObject *environ = PyDict_New();
   for (size_t i = 0; i < headers->count; i++) {
@@ -239,176 +509,423 @@ void WsgiApp_handle_request(WsgiApp *app, int64_t request_id,
     Py_DECREF(key);
     Py_DECREF(value);
   }
-  PyObject *input_key = PyUnicode_FromString("wsgi.input");
-  PyObject *bytes = PyBytes_FromString(body);
-  PyObject *bytes_file = PyObject_CallOneArg(BytesIO, bytes);
-  PyDict_SetItem(environ, input_key, bytes_file);
-  Py_DECREF(input_key);
-  Py_DECREF(bytes);
-  Py_DECREF(bytes_file);
-
+  // The body is read lazily from Go as the app consumes wsgi.input
+  PyObject *py_request_id = PyLong_FromLongLong(request_id);
+  PyObject *wsgi_input = PyObject_CallOneArg(build_wsgi_input, py_request_id);
+  PyDict_SetItemString(environ, "wsgi.input", wsgi_input);
+  Py_DECREF(wsgi_input);
+
+  // Output written to wsgi.errors is logged with the request id
+  PyObject *wsgi_errors = PyObject_CallOneArg(log_writer, py_request_id);
   char *extra_keys[] = {"wsgi.multithread", "wsgi.multiprocess",
-                        "wsgi.run_once", "wsgi.version", "wsgi.errors"};
-  PyObject *extra_values[] = {Py_True, Py_True, Py_False, wsgi_version,
-                              sys_stderr};
-  for (size_t i = 0; i < 5; i++) {
+                        "wsgi.run_once",    "wsgi.version",
+                        "wsgi.errors",      "wsgi.file_wrapper"};
+  PyObject *extra_values[] = {Py_True,      Py_True,     Py_False,
+                              wsgi_version, wsgi_errors, wsgi_file_wrapper};
+  for (size_t i = 0; i < 6; i++) {
     PyObject *key = PyUnicode_FromString(extra_keys[i]);
     PyDict_SetItem(environ, key, extra_values[i]);
     Py_DECREF(key);
   }
+  Py_DECREF(wsgi_errors);
+  Py_DECREF(py_request_id);
   RequestResponse *r =
       (RequestResponse *)PyObject_CallObject((PyObject *)&ResponseType, NULL);
   r->app = app;
   r->request_id = request_id;
   r->request_environ = environ;
+  atomic_fetch_add(&wsgi_queued, 1);
   PyObject_CallOneArg(task_queue_put, (PyObject *)r);
 
+  // The reference to r is kept until Go calls RequestResponse_cleanup
+
+  TimedGil_release(&gil);
+  return r;
+}
+
+/*
+Wsgi_queue_depth returns the number of WSGI requests waiting for a thread of
+the pool. It doesn't need the GIL.
+*/
+long Wsgi_queue_depth(void) { return atomic_load(&wsgi_queued); }
+
+/*
+Wsgi_start_threads grows the pool of threads that run WSGI requests. The pool
+is shared by all WSGI apps, each thread takes requests from the task queue
+and acquires the GIL on its own, so requests overlap while the app waits on
+I/O.
+*/
+void Wsgi_start_threads(int count) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  PyObject *py_count = PyLong_FromLong(count);
+  PyObject *result = PyObject_CallOneArg(wsgi_start_threads, py_count);
+  if (!result) {
+    PyErr_Print();
+  }
+  Py_XDECREF(result);
+  Py_DECREF(py_count);
+  PyGILState_Release(gstate);
+}
+
+/*
+RequestResponse_cancel is called when a request times out. It raises a
+TimeoutError in the thread running the app, the exception is delivered as
+soon as the thread executes Python code again.
+*/
+void RequestResponse_cancel(RequestResponse *self) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  Py_BEGIN_CRITICAL_SECTION(self);
+  self->cancelled = 1;
+  if (self->thread_id) {
+    PyThreadState_SetAsyncExc(self->thread_id, PyExc_TimeoutError);
+  }
+  Py_END_CRITICAL_SECTION();
+  PyGILState_Release(gstate);
+}
+
+/*
+RequestResponse_worker returns the name of the thread running the request. It
+doesn't need the GIL, the name is set before the app is called and Go reads it
+once the response has started.
+*/
+const char *RequestResponse_worker(RequestResponse *self) {
+  return self->worker;
+}
+
+/*
+RequestResponse_cleanup releases the reference held by Go for the request
+lifetime.
+*/
+void RequestResponse_cleanup(RequestResponse *self) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  Py_DECREF(self);
   PyGILState_Release(gstate);
 }
 
-static void MapKeyVal_free(MapKeyVal *map, size_t pos) {
-  if (pos > map->count) {
-    pos = map->count;
+void MapKeyVal_free(MapKeyVal *map) { free(map); }
+
+/*
+Format_exception returns the traceback of exc as a string. When exc is NULL
+the exception being handled is used and cleared.
+*/
+static PyObject *Format_exception(PyObject *exc) {
+  PyObject *text = NULL;
+  if (exc) {
+    text = PyObject_CallOneArg(format_exception, exc);
+  } else {
+#if PY_MINOR_VERSION >= 12
+    // PyErr_GetRaisedException was introduced in Python 3.12
+    exc = PyErr_GetRaisedException();
+#else
+    PyObject *type, *traceback;
+    PyErr_Fetch(&type, &exc, &traceback);
+    PyErr_NormalizeException(&type, &exc, &traceback);
+    if (exc && traceback) {
+      PyException_SetTraceback(exc, traceback);
+    }
+    Py_XDECREF(type);
+    Py_XDECREF(traceback);
+#endif
+    if (exc) {
+      text = PyObject_CallOneArg(format_exception, exc);
+      Py_DECREF(exc);
+    }
+  }
+  if (!text) {
+    PyErr_Clear();
+  }
+  return text;
+}
+
+/*
+Response_log_exception sends the traceback of exc, or of the exception being
+handled when exc is NULL, to the Caddy logger as a single entry.
+*/
+static void Response_log_exception(RequestResponse *self, PyObject *exc) {
+  PyObject *text = Format_exception(exc);
+  if (text) {
+    const char *message = PyUnicode_AsUTF8(text);
+    Py_BEGIN_ALLOW_THREADS wsgi_log(self->request_id, (char *)message);
+    Py_END_ALLOW_THREADS Py_DECREF(text);
+  }
+}
+
+/*
+Response_headers_to_MapKeyVal copies the headers passed to start_response into
+a MapKeyVal. Returns NULL with an exception set if they're invalid.
+*/
+static MapKeyVal *Response_headers_to_MapKeyVal(RequestResponse *self) {
+  if (!self->response_headers) {
+    PyErr_SetString(PyExc_RuntimeError,
+                    "expected response headers to be non-empty");
+    return NULL;
+  }
+  if (!PyTuple_Check(self->response_headers) &&
+      !PyList_Check(self->response_headers)) {
+    PyErr_SetString(PyExc_RuntimeError,
+                    "response headers is not list or tuple");
+    return NULL;
+  }
+  return MapKeyVal_from_pairs(
+      self->response_headers, 0,
+      "expected response headers to be tuples with 2 strings");
+}
+
+/*
+Response_write passes a chunk of the response body to Go and waits until it's
+written to the client. Headers are sent along with the first chunk. Returns
+0 if the client can't receive more data.
+*/
+static int Response_write(RequestResponse *self, MapKeyVal *headers,
+                          PyObject *body, uint8_t more_body) {
+  char *body_str = NULL;
+  Py_ssize_t body_len = 0;
+  if (body) {
+    PyBytes_AsStringAndSize(body, &body_str, &body_len);
+  }
+  int result;
+  Py_BEGIN_ALLOW_THREADS result =
+      wsgi_write_response(self->request_id, self->response_status, headers,
+                          body_str, body_len, more_body);
+  Py_END_ALLOW_THREADS return result;
+}
+
+/*
+Response_sendfile passes the file of a wsgi.file_wrapper to Go, where it's
+served with sendfile and support for range requests. Returns 0 if the file
+can't be served that way and the response has to be iterated instead.
+*/
+static int Response_sendfile(RequestResponse *self) {
+  if (self->response_status != 200) {
+    return 0;
+  }
+  PyObject *filelike =
+      PyObject_GetAttrString(self->response_body, "filelike");
+  if (!filelike) {
+    PyErr_Clear();
+    return 0;
+  }
+  int fd = -1;
+  PyObject *fileno = PyObject_CallMethod(filelike, "fileno", NULL);
+  if (fileno) {
+    fd = PyLong_AsLong(fileno);
+    Py_DECREF(fileno);
+  }
+  // Only files that weren't read yet, Go serves them from the start
+  long long offset = -1;
+  PyObject *position = PyObject_CallMethod(filelike, "tell", NULL);
+  if (position) {
+    offset = PyLong_AsLongLong(position);
+    Py_DECREF(position);
+  }
+  PyObject *name = PyObject_GetAttrString(filelike, "name");
+  PyErr_Clear();
+  Py_DECREF(filelike);
+  if (fd < 0 || offset != 0) {
+    Py_XDECREF(name);
+    return 0;
+  }
+
+  MapKeyVal *http_headers = Response_headers_to_MapKeyVal(self);
+  if (!http_headers) {
+    Py_XDECREF(name);
+    return -1;
   }
-  for (size_t i = 0; i < pos; i++) {
-    free(map->keys[i]);
-    free(map->values[i]);
+  // Go takes ownership of the duplicated descriptor, the app closes its file
+  int file_fd = dup(fd);
+  char *name_str = name && PyUnicode_Check(name)
+                       ? (char *)PyUnicode_AsUTF8(name)
+                       : "";
+  Py_BEGIN_ALLOW_THREADS wsgi_send_file(self->request_id,
+                                        self->response_status, http_headers,
+                                        file_fd, name_str);
+  Py_END_ALLOW_THREADS MapKeyVal_free(http_headers);
+  Py_XDECREF(name);
+  return 1;
+}
+
+/*
+Response_release_thread is called when the thread is done with the request, it
+goes back to the pool to run other requests so it can't be cancelled anymore.
+A timeout that arrived but wasn't raised yet is discarded.
+*/
+static void Response_release_thread(RequestResponse *self) {
+  Py_BEGIN_CRITICAL_SECTION(self);
+  if (self->thread_id) {
+    PyThreadState_SetAsyncExc(self->thread_id, NULL);
+    self->thread_id = 0;
   }
-  free(map);
+  Py_END_CRITICAL_SECTION();
+  PyObject *py_request_id = PyLong_FromLong(0);
+  Py_XDECREF(PyContextVar_Set(current_request_id, py_request_id));
+  Py_DECREF(py_request_id);
 }
 
 static PyObject *response_callback(PyObject *self, PyObject *args) {
   RequestResponse *response = (RequestResponse *)PyTuple_GetItem(args, 0);
   PyObject *exc_info = PyTuple_GetItem(args, 1);
+  uint8_t headers_sent = 0;
   if (exc_info != Py_None) {
-    PyErr_Display(NULL, exc_info, NULL);
+    Response_log_exception(response, exc_info);
     goto finalize_error;
   }
-
-  char *response_body = NULL;
-  if (response->response_body) {
-    PyObject *iterator = PyObject_GetIter(response->response_body);
-    if (iterator) {
-      PyObject *close_iterator = PyObject_GetAttrString(iterator, "close");
-      PyObject *item;
-      while ((item = PyIter_Next(iterator))) {
-        if (!PyBytes_Check(item)) {
-          PyErr_SetString(PyExc_RuntimeError,
-                          "expected response body items to be bytes");
-          PyErr_Print();
-          Py_DECREF(item);
-          PyObject_CallNoArgs(close_iterator);
-          Py_DECREF(close_iterator);
-          Py_DECREF(iterator);
-          if (response_body != NULL) {
-            free(response_body);
-          }
-          goto finalize_error;
-        }
-        char *previous_body = response_body;
-        if (previous_body == NULL) {
-          response_body = concatenate_strings("", PyBytes_AsString(item));
-        } else {
-          response_body =
-              concatenate_strings(previous_body, PyBytes_AsString(item));
-          free(previous_body);
-        }
-        Py_DECREF(item);
-      }
-      PyObject_CallNoArgs(close_iterator);
-      Py_DECREF(close_iterator);
-      Py_DECREF(iterator);
-    } else {
-      PyErr_Print();
-      goto finalize_error;
-    }
-  } else {
+  if (!response->response_body) {
     PyErr_SetString(PyExc_RuntimeError,
                     "expected response body to be non-empty");
-    PyErr_Print();
+    Response_log_exception(response, NULL);
     goto finalize_error;
   }
 
-  if (PyErr_Occurred()) {
-    PyErr_Print();
-    if (response_body != NULL) {
-      free(response_body);
-    }
-    goto finalize_error;
+  int sent_file = 0;
+  if (PyObject_IsInstance(response->response_body, wsgi_file_wrapper) == 1) {
+    sent_file = Response_sendfile(response);
+    headers_sent = sent_file == 1;
   }
 
-  if (!response->response_headers) {
-    PyErr_SetString(PyExc_RuntimeError,
-                    "expected response headers to be non-empty");
-    PyErr_Print();
-    if (response_body != NULL) {
-      free(response_body);
+  // Each item of the iterable is written to the client as soon as it's
+  // produced, headers are sent with the first non-empty item.
+  PyObject *iterator =
+      sent_file ? NULL : PyObject_GetIter(response->response_body);
+  if (iterator) {
+    PyObject *item;
+    while ((item = PyIter_Next(iterator))) {
+      if (!PyBytes_Check(item)) {
+        PyErr_SetString(PyExc_RuntimeError,
+                        "expected response body items to be bytes");
+        Py_DECREF(item);
+        break;
+      }
+      if (PyBytes_GET_SIZE(item) == 0) {
+        Py_DECREF(item);
+        continue;
+      }
+      MapKeyVal *http_headers = NULL;
+      if (!headers_sent) {
+        http_headers = Response_headers_to_MapKeyVal(response);
+        if (!http_headers) {
+          Py_DECREF(item);
+          break;
+        }
+      }
+      int written = Response_write(response, http_headers, item, 1);
+      headers_sent = 1;
+      MapKeyVal_free(http_headers);
+      Py_DECREF(item);
+      if (!written) {
+        // Client went away or request timed out
+        break;
+      }
     }
-    goto finalize_error;
+    Py_DECREF(iterator);
   }
-  PyObject *iterator = PyObject_GetIter(response->response_headers);
-  if (!iterator) {
-    PyErr_Print();
-    if (response_body != NULL) {
-      free(response_body);
-    }
-    goto finalize_error;
+
+  // The close method is called even if the response was interrupted, an
+  // error raised while iterating takes precedence over one raised by close
+  PyObject *type, *value, *traceback;
+  PyErr_Fetch(&type, &value, &traceback);
+  if (PyObject_HasAttrString(response->response_body, "close")) {
+    PyObject *close_result =
+        PyObject_CallMethod(response->response_body, "close", NULL);
+    Py_XDECREF(close_result);
   }
-  Py_ssize_t headers_count = 0;
-  if (PyTuple_Check(response->response_headers)) {
-    headers_count = PyTuple_Size(response->response_headers);
-  } else if (PyList_Check(response->response_headers)) {
-    headers_count = PyList_Size(response->response_headers);
-  } else {
-    PyErr_SetString(PyExc_RuntimeError,
-                    "response headers is not list or tuple");
-    PyErr_Print();
-    Py_DECREF(iterator);
-    if (response_body != NULL) {
-      free(response_body);
-    }
-    goto finalize_error;
+  if (type) {
+    PyErr_Restore(type, value, traceback);
   }
 
-  MapKeyVal *http_headers = MapKeyVal_new(headers_count);
+  if (PyErr_Occurred()) {
+    Response_log_exception(response, NULL);
+    goto finalize_error;
+  }
 
-  PyObject *key, *value, *item;
-  size_t pos = 0;
-  while ((item = PyIter_Next(iterator))) {
-    if (!PyTuple_Check(item) || PyTuple_Size(item) != 2) {
-      PyErr_SetString(PyExc_RuntimeError,
-                      "expected response headers to be tuples with 2 items");
-      PyErr_Print();
-      Py_DECREF(item);
-      Py_DECREF(iterator);
-      MapKeyVal_free(http_headers, pos);
+  Response_release_thread(response);
+  if (sent_file) {
+    Py_RETURN_NONE;
+  }
+  MapKeyVal *http_headers = NULL;
+  if (!headers_sent) {
+    http_headers = Response_headers_to_MapKeyVal(response);
+    if (!http_headers) {
+      Response_log_exception(response, NULL);
       goto finalize_error;
     }
-    key = PyTuple_GetItem(item, 0);
-    value = PyTuple_GetItem(item, 1);
-    http_headers->keys[pos] = copy_pystring(key);
-    http_headers->values[pos] = copy_pystring(value);
-    Py_DECREF(item);
-    pos++;
   }
-  Py_DECREF(iterator);
-
-  Py_BEGIN_ALLOW_THREADS wsgi_write_response(response->request_id,
-                                             response->response_status,
-                                             http_headers, response_body);
-  Py_END_ALLOW_THREADS goto end;
+  Response_write(response, http_headers, NULL, 0);
+  MapKeyVal_free(http_headers);
+  Py_RETURN_NONE;
 
 finalize_error:
-  Py_BEGIN_ALLOW_THREADS wsgi_write_response(response->request_id, 500, NULL,
-                                             NULL);
-  Py_END_ALLOW_THREADS
+  Response_release_thread(response);
+  // If headers were already sent the response is just cut short
+  response->response_status = 500;
+  Response_write(response, NULL, NULL, 0);
+  Py_RETURN_NONE;
+}
 
-      end : Py_RETURN_NONE;
+/*
+read_body fills a buffer with the next chunk of the request body, it's used
+by wsgi.input. Returns 0 when the whole body was read.
+*/
+static PyObject *read_body(PyObject *self, PyObject *args) {
+  long long request_id;
+  Py_buffer buf;
+  if (!PyArg_ParseTuple(args, "Lw*", &request_id, &buf)) {
+    return NULL;
+  }
+  int64_t n;
+  Py_BEGIN_ALLOW_THREADS n = wsgi_read_body(request_id, buf.buf, buf.len);
+  Py_END_ALLOW_THREADS PyBuffer_Release(&buf);
+  if (n < 0) {
+    PyErr_SetString(PyExc_OSError, "failed to read request body");
+    return NULL;
+  }
+  return PyLong_FromLongLong(n);
+}
+
+/*
+log_message sends a message written to sys.stderr or wsgi.errors to the
+Caddy logger.
+*/
+static PyObject *log_message(PyObject *self, PyObject *args) {
+  long long request_id;
+  const char *message;
+  if (!PyArg_ParseTuple(args, "Ls", &request_id, &message)) {
+    return NULL;
+  }
+  Py_BEGIN_ALLOW_THREADS wsgi_log(request_id, (char *)message);
+  Py_END_ALLOW_THREADS Py_RETURN_NONE;
+}
+
+/*
+log_record sends a record of the logging module to the Caddy logger, with the
+level, the logger name and the extras of the record as fields.
+*/
+static PyObject *log_record(PyObject *self, PyObject *args) {
+  long long request_id;
+  int level;
+  const char *name, *message;
+  PyObject *extras;
+  if (!PyArg_ParseTuple(args, "LissO", &request_id, &level, &name, &message,
+                        &extras)) {
+    return NULL;
+  }
+  MapKeyVal *fields =
+      MapKeyVal_from_pairs(extras, 0, "expected extras to be pairs of str");
+  if (!fields) {
+    return NULL;
+  }
+  Py_BEGIN_ALLOW_THREADS python_log(request_id, level, (char *)name,
+                                    (char *)message, fields);
+  Py_END_ALLOW_THREADS MapKeyVal_free(fields);
+  Py_RETURN_NONE;
 }
 
 static PyMethodDef CaddysnakeMethods[] = {
     {"response_callback", response_callback, METH_VARARGS,
      "Callback to process response."},
+    {"read_body", read_body, METH_VARARGS, "Read a chunk of the request body."},
+    {"log", log_message, METH_VARARGS, "Send a message to the Caddy logger."},
+    {"log_record", log_record, METH_VARARGS,
+     "Send a logging record to the Caddy logger."},
     {NULL, NULL, 0, NULL} /* Sentinel */
 };
 
@@ -418,12 +935,61 @@ static struct PyModuleDef CaddysnakeModule = {
 
 // ASGI 3.0 protocol implementation
 struct AsgiApp {
+  // Replaced on reload, see App_get_handler
   PyObject *handler;
+  PyThread_type_lock handler_lock;
   PyObject *state;
 
   PyObject *lifespan_shutdown;
 };
 
+/*
+Asgi_start_event_loop starts the loop shared by all ASGI apps, event_loop is
+one of auto, asyncio or uvloop. It's started once, after the first app is
+imported so uvloop can be found in its venv. The kind of loop that's running
+is copied to running. Returns 0 on failure.
+*/
+uint8_t Asgi_start_event_loop(const char *event_loop, char *running,
+                              size_t running_len) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  PyObject *kind = PyUnicode_FromString(event_loop);
+  PyObject *result = PyObject_CallOneArg(start_event_loop, kind);
+  Py_DECREF(kind);
+  PyObject *loop, *loop_kind;
+  if (!result || !PyArg_ParseTuple(result, "OU", &loop, &loop_kind)) {
+    PyErr_Print();
+    Py_XDECREF(result);
+    PyGILState_Release(gstate);
+    return 0;
+  }
+  snprintf(running, running_len, "%s", PyUnicode_AsUTF8(loop_kind));
+  Py_INCREF(loop);
+  PyObject *expected = NULL;
+  if (!atomic_compare_exchange_strong(&asyncio_Loop, &expected, loop)) {
+    Py_DECREF(loop);
+  }
+  Py_DECREF(result);
+  PyGILState_Release(gstate);
+  return 1;
+}
+
+/*
+Asgi_set_executor_threads sets the size of the default executor of the loop,
+used by run_in_executor and by frameworks to run sync endpoints. It's shared
+by all ASGI apps and only grows.
+*/
+void Asgi_set_executor_threads(int count) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  PyObject *py_count = PyLong_FromLong(count);
+  PyObject *result = PyObject_CallOneArg(set_executor_threads, py_count);
+  if (!result) {
+    PyErr_Print();
+  }
+  Py_XDECREF(result);
+  Py_DECREF(py_count);
+  PyGILState_Release(gstate);
+}
+
 AsgiApp *AsgiApp_import(const char *module_name, const char *app_name,
                         const char *venv_path) {
   AsgiApp *app = malloc(sizeof(AsgiApp));
@@ -433,50 +999,74 @@ AsgiApp *AsgiApp_import(const char *module_name, const char *app_name,
   app->lifespan_shutdown = NULL;
   PyGILState_STATE gstate = PyGILState_Ensure();
 
-  // Add venv_path into sys.path list
-  if (venv_path) {
-    PyObject *sysPath = PySys_GetObject("path");
-    PyList_Append(sysPath, PyUnicode_FromString(venv_path));
-  }
-
-  PyObject *module = PyImport_ImportModule(module_name);
-  if (module == NULL) {
-    PyErr_Print();
-    PyGILState_Release(gstate);
-    return NULL;
-  }
-
-  app->handler = PyObject_GetAttrString(module, app_name);
-  if (!app->handler || !PyCallable_Check(app->handler)) {
-    if (PyErr_Occurred()) {
-      PyErr_Print();
-    }
+  app->handler = Py_import_app(module_name, app_name, venv_path);
+  if (!app->handler) {
     PyGILState_Release(gstate);
+    free(app);
     return NULL;
   }
+  app->handler_lock = PyThread_allocate_lock();
   app->state = PyDict_New();
 
   PyGILState_Release(gstate);
   return app;
 }
 
+/*
+AsgiApp_reload imports the app again. Running requests finish with the
+previous app. When lifespan is enabled, the previous app is shut down and the
+new one is started with an empty state. Returns 0 if the import fails, then the
+previous app is kept, and -1 if the lifespan startup fails.
+*/
+int AsgiApp_reload(AsgiApp *app, const char *module_name,
+                   const char *app_name) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  PyObject *handler = Py_reload_app(module_name, app_name);
+  if (!handler) {
+    PyGILState_Release(gstate);
+    return 0;
+  }
+  int result = 1;
+  if (app->lifespan_shutdown) {
+    AsgiApp_lifespan_shutdown(app);
+    App_set_handler(&app->handler, app->handler_lock, handler);
+    PyDict_Clear(app->state);
+    if (!AsgiApp_lifespan_startup(app)) {
+      result = -1;
+    }
+  } else {
+    App_set_handler(&app->handler, app->handler_lock, handler);
+  }
+  PyGILState_Release(gstate);
+  return result;
+}
+
 uint8_t AsgiApp_lifespan_startup(AsgiApp *app) {
   PyGILState_STATE gstate = PyGILState_Ensure();
 
+  // PyTuple_SetItem steals references, the app keeps its own. The state dict
+  // must outlive the startup, it's copied into the scope of every request.
+  PyObject *handler = App_get_handler(&app->handler, app->handler_lock);
+  Py_INCREF(app->state);
   PyObject *args = PyTuple_New(2);
-  PyTuple_SetItem(args, 0, app->handler);
+  PyTuple_SetItem(args, 0, handler);
   PyTuple_SetItem(args, 1, app->state);
-  PyObject *result = PyObject_Call(build_lifespan, args, NULL);
+  PyObject *lifespan = PyObject_Call(build_lifespan, args, NULL);
   Py_DECREF(args);
 
-  PyObject *lifespan_startup = PyTuple_GetItem(result, 0);
-  app->lifespan_shutdown = PyTuple_GetItem(result, 1);
+  // Items of the tuple are borrowed, the app keeps its own reference to the
+  // shutdown callable
+  PyObject *lifespan_startup = PyTuple_GetItem(lifespan, 0);
+  PyObject *lifespan_shutdown = PyTuple_GetItem(lifespan, 1);
+  Py_INCREF(lifespan_shutdown);
+  Py_XSETREF(app->lifespan_shutdown, lifespan_shutdown);
 
-  result = PyObject_CallNoArgs(lifespan_startup);
+  PyObject *result = PyObject_CallNoArgs(lifespan_startup);
 
   uint8_t status = result == Py_True;
 
-  Py_DECREF(lifespan_startup);
+  Py_XDECREF(result);
+  Py_DECREF(lifespan);
 
   PyGILState_Release(gstate);
 
@@ -494,6 +1084,8 @@ uint8_t AsgiApp_lifespan_shutdown(AsgiApp *app) {
 
   uint8_t status = result == Py_True;
 
+  Py_XDECREF(result);
+
   PyGILState_Release(gstate);
 
   return status;
@@ -503,8 +1095,12 @@ struct AsgiEvent {
   PyObject_HEAD AsgiApp *app;
   uint64_t request_id;
   PyObject *event_ts;
+  PyObject *receive_event_ts;
   PyObject *future;
   PyObject *request_body;
+  uint8_t more_body;
+  uint8_t body_received;
+  uint8_t disconnected;
 };
 
 static PyObject *AsgiEvent_new(PyTypeObject *type, PyObject *args,
@@ -514,14 +1110,19 @@ static PyObject *AsgiEvent_new(PyTypeObject *type, PyObject *args,
   if (self != NULL) {
     self->request_id = 0;
     self->event_ts = NULL;
+    self->receive_event_ts = NULL;
     self->future = NULL;
     self->request_body = NULL;
+    self->more_body = 0;
+    self->body_received = 0;
+    self->disconnected = 0;
   }
   return (PyObject *)self;
 }
 
 static void AsgiEvent_dealloc(AsgiEvent *self) {
   Py_XDECREF(self->event_ts);
+  Py_XDECREF(self->receive_event_ts);
   // Future is freed in AsgiEvent_result
   // Py_XDECREF(self->future);
   // Request body is freed in AsgiEvent_receive_end
@@ -529,46 +1130,152 @@ static void AsgiEvent_dealloc(AsgiEvent *self) {
   Py_TYPE(self)->tp_free((PyObject *)self);
 }
 
-void AsgiEvent_set(AsgiEvent *self, const char *body) {
+static PyObject *Event_ts_call(PyObject *event_ts, const char *method) {
+  PyObject *fn = PyObject_GetAttrString(event_ts, method);
+  PyObject *result = PyObject_CallNoArgs(fn);
+  Py_DECREF(fn);
+  return result;
+}
+
+/*
+AsgiEvent_set wakes up a pending send.
+*/
+void AsgiEvent_set(AsgiEvent *self) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  Py_XDECREF(Event_ts_call(self->event_ts, "set"));
+  PyGILState_Release(gstate);
+}
+
+/*
+AsgiEvent_set_receive wakes up a pending receive with a chunk of the request
+body. Send and receive use separate events because apps may await both at the
+same time, e.g. to listen for a disconnect while streaming a response.
+*/
+void AsgiEvent_set_receive(AsgiEvent *self, const char *body, size_t body_len,
+                           uint8_t more_body) {
   PyGILState_STATE gstate = PyGILState_Ensure();
   if (body) {
-    self->request_body = PyBytes_FromString(body);
+    PyObject *request_body = PyBytes_FromStringAndSize(body, body_len);
+    Py_BEGIN_CRITICAL_SECTION(self);
+    Py_XSETREF(self->request_body, request_body);
+    self->more_body = more_body;
+    Py_END_CRITICAL_SECTION();
+  }
+  Py_XDECREF(Event_ts_call(self->receive_event_ts, "set"));
+  PyGILState_Release(gstate);
+}
+
+/*
+AsgiEvent_disconnect is called when the client goes away or the response is
+finished. It wakes up any pending receive/send so the app gets an
+http.disconnect event.
+*/
+void AsgiEvent_disconnect(AsgiEvent *self) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  Py_BEGIN_CRITICAL_SECTION(self);
+  self->disconnected = 1;
+  Py_END_CRITICAL_SECTION();
+  Py_XDECREF(Event_ts_call(self->event_ts, "set"));
+  Py_XDECREF(Event_ts_call(self->receive_event_ts, "set"));
+  PyGILState_Release(gstate);
+}
+
+/*
+AsgiEvent_cancel is called when a request times out, it cancels the task
+running the app.
+*/
+void AsgiEvent_cancel(AsgiEvent *self) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  PyObject *future;
+  Py_BEGIN_CRITICAL_SECTION(self);
+  future = self->future;
+  Py_XINCREF(future);
+  Py_END_CRITICAL_SECTION();
+  if (future) {
+    PyObject *cancel = PyObject_GetAttrString(future, "cancel");
+    Py_XDECREF(PyObject_CallNoArgs(cancel));
+    Py_DECREF(cancel);
+    Py_DECREF(future);
   }
-  PyObject *set_fn = PyObject_GetAttrString((PyObject *)self->event_ts, "set");
-  PyObject_CallNoArgs(set_fn);
-  Py_DECREF(set_fn);
+  PyGILState_Release(gstate);
+}
+
+/*
+AsgiEvent_cleanup releases the reference held by Go for the request lifetime.
+*/
+void AsgiEvent_cleanup(AsgiEvent *self) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  Py_DECREF(self);
   PyGILState_Release(gstate);
 }
 
 static PyObject *AsgiEvent_wait(AsgiEvent *self, PyObject *args) {
-  PyObject *wait_fn =
-      PyObject_GetAttrString((PyObject *)self->event_ts, "wait");
-  PyObject *coro = PyObject_CallNoArgs(wait_fn);
-  Py_DECREF(wait_fn);
-  return coro;
+  return Event_ts_call(self->event_ts, "wait");
 }
 
 static PyObject *AsgiEvent_clear(AsgiEvent *self, PyObject *args) {
-  PyObject *clear_fn =
-      PyObject_GetAttrString((PyObject *)self->event_ts, "clear");
-  PyObject_CallNoArgs(clear_fn);
-  Py_DECREF(clear_fn);
+  Py_XDECREF(Event_ts_call(self->event_ts, "clear"));
+  Py_RETURN_NONE;
+}
+
+static PyObject *AsgiEvent_receive_wait(AsgiEvent *self, PyObject *args) {
+  return Event_ts_call(self->receive_event_ts, "wait");
+}
+
+static PyObject *AsgiEvent_receive_clear(AsgiEvent *self, PyObject *args) {
+  Py_XDECREF(Event_ts_call(self->receive_event_ts, "clear"));
   Py_RETURN_NONE;
 }
 
 static PyObject *AsgiEvent_receive_start(AsgiEvent *self, PyObject *args) {
+  uint8_t disconnected, body_received;
+  Py_BEGIN_CRITICAL_SECTION(self);
+  disconnected = self->disconnected;
+  body_received = self->body_received;
+  Py_END_CRITICAL_SECTION();
+  if (disconnected) {
+    AsgiEvent_set_receive(self, NULL, 0, 0);
+    Py_RETURN_NONE;
+  }
+  if (body_received) {
+    // Once the body is consumed receive blocks until the client disconnects
+    Py_RETURN_NONE;
+  }
   asgi_receive_start(self->request_id, self);
   Py_RETURN_NONE;
 }
 
 static PyObject *AsgiEvent_receive_end(AsgiEvent *self, PyObject *args) {
+  PyObject *request_body;
+  uint8_t disconnected, more_body;
+  Py_BEGIN_CRITICAL_SECTION(self);
+  request_body = self->request_body;
+  self->request_body = NULL;
+  disconnected = self->disconnected;
+  more_body = self->more_body;
+  if (!disconnected) {
+    self->body_received = !more_body;
+    self->more_body = 0;
+  }
+  Py_END_CRITICAL_SECTION();
+
   PyObject *data = PyDict_New();
+  if (disconnected) {
+    Py_XDECREF(request_body);
+    PyObject *data_type = PyUnicode_FromString("http.disconnect");
+    PyDict_SetItemString(data, "type", data_type);
+    Py_DECREF(data_type);
+    return data;
+  }
+  if (!request_body) {
+    request_body = PyBytes_FromString("");
+  }
   PyObject *data_type = PyUnicode_FromString("http.request");
   PyDict_SetItemString(data, "type", data_type);
-  PyDict_SetItemString(data, "body", self->request_body);
-  PyDict_SetItemString(data, "more_body", Py_False);
+  PyDict_SetItemString(data, "body", request_body);
+  PyDict_SetItemString(data, "more_body", more_body ? Py_True : Py_False);
   Py_DECREF(data_type);
-  Py_DECREF(self->request_body);
+  Py_DECREF(request_body);
   return data;
 }
 
@@ -576,69 +1283,82 @@ static PyObject *AsgiEvent_receive_end(AsgiEvent *self, PyObject *args) {
 AsgiEvent_result is called when an execution of AsgiApp finishes.
 */
 static PyObject *AsgiEvent_result(AsgiEvent *self, PyObject *args) {
-  PyObject *future_exception =
-      PyObject_GetAttrString(self->future, "exception");
+  // Freeing future here because there is a circular reference
+  // between AsgiEvent and Future.
+  PyObject *future;
+  Py_BEGIN_CRITICAL_SECTION(self);
+  future = self->future;
+  self->future = NULL;
+  Py_END_CRITICAL_SECTION();
+  if (!future) {
+    Py_RETURN_NONE;
+  }
+
+  PyObject *future_exception = PyObject_GetAttrString(future, "exception");
   PyObject *exc = PyObject_CallNoArgs(future_exception);
-  if (exc != Py_None) {
-#if PY_MINOR_VERSION >= 12
-    // PyErr_DisplayException was introduced in Python 3.12
-    PyErr_DisplayException(exc);
-#else
-    PyErr_Display(NULL, exc, NULL);
-#endif
+  if (!exc) {
+    // exception() raises CancelledError when the request timed out
+    PyErr_Clear();
+  } else if (exc != Py_None) {
+    PyObject *text = Format_exception(exc);
+    if (text) {
+      asgi_log(self->request_id, (char *)PyUnicode_AsUTF8(text));
+      Py_DECREF(text);
+    }
     Py_DECREF(exc);
     asgi_cancel_request(self->request_id);
   }
   Py_DECREF(future_exception);
-
-  // Freeing future here because there is a circular reference
-  // between AsgiEvent and Future.
-  Py_DECREF(self->future);
-  self->future = NULL;
+  Py_DECREF(future);
 
   Py_RETURN_NONE;
 }
 
+/*
+AsgiHeaders_to_MapKeyVal copies ASGI headers into a MapKeyVal. Headers are kept
+as a list of pairs so repeated names like Set-Cookie reach the client as
+separate header lines, in the order they were sent.
+*/
+static MapKeyVal *AsgiHeaders_to_MapKeyVal(PyObject *headers) {
+  if (!headers) {
+    return MapKeyVal_new(0, 0);
+  }
+  return MapKeyVal_from_pairs(headers, 1,
+                              "expected headers to be pairs of bytes");
+}
+
 static PyObject *AsgiEvent_send(AsgiEvent *self, PyObject *args) {
+  uint8_t disconnected;
+  Py_BEGIN_CRITICAL_SECTION(self);
+  disconnected = self->disconnected;
+  Py_END_CRITICAL_SECTION();
+  if (disconnected) {
+    // Client is gone, sending is a no-op
+    AsgiEvent_set(self);
+    Py_RETURN_NONE;
+  }
   PyObject *data = PyTuple_GetItem(args, 0);
   PyObject *data_type = PyDict_GetItemString(data, "type");
   if (PyUnicode_CompareWithASCIIString(data_type, "http.response.start") == 0) {
     PyObject *status_code = PyDict_GetItemString(data, "status");
     PyObject *headers = PyDict_GetItemString(data, "headers");
 
-    PyObject *iterator = PyObject_GetIter(headers);
-    Py_ssize_t headers_count = 0;
-    if (PyTuple_Check(headers)) {
-      headers_count = PyTuple_Size(headers);
-    } else if (PyList_Check(headers)) {
-      headers_count = PyList_Size(headers);
+    if (!status_code || !PyLong_Check(status_code)) {
+      PyErr_SetString(PyExc_RuntimeError,
+                      "expected response status to be an integer");
+      return NULL;
     }
-    MapKeyVal *http_headers = MapKeyVal_new(headers_count);
 
-    PyObject *key, *value, *item;
-    size_t pos = 0;
-    while ((item = PyIter_Next(iterator))) {
-      // if (!PyTuple_Check(item) || PyTuple_Size(item) != 2) {
-      //   PyErr_SetString(PyExc_RuntimeError,
-      //                   "expected response headers to be tuples with 2
-      //                   items");
-      //   PyErr_Print();
-      //   Py_DECREF(item);
-      //   Py_DECREF(iterator);
-      //   MapKeyVal_free(http_headers, pos);
-      //   goto finalize_error;
-      // }
-      key = PyTuple_GetItem(item, 0);
-      value = PyTuple_GetItem(item, 1);
-      http_headers->keys[pos] = copy_pybytes(key);
-      http_headers->values[pos] = copy_pybytes(value);
-      Py_DECREF(item);
-      pos++;
+    MapKeyVal *http_headers = AsgiHeaders_to_MapKeyVal(headers);
+    if (!http_headers) {
+      return NULL;
     }
-    Py_DECREF(iterator);
+
+    PyObject *trailers = PyDict_GetItemString(data, "trailers");
+    uint8_t send_trailers = trailers && PyObject_IsTrue(trailers) == 1;
 
     asgi_set_headers(self->request_id, PyLong_AsLong(status_code), http_headers,
-                     self);
+                     send_trailers, self);
   } else if (PyUnicode_CompareWithASCIIString(data_type,
                                               "http.response.body") == 0) {
     PyObject *more_body = PyDict_GetItemString(data, "more_body");
@@ -650,6 +1370,59 @@ static PyObject *AsgiEvent_send(AsgiEvent *self, PyObject *args) {
     PyObject *body = PyDict_GetItemString(data, "body");
     asgi_send_response(self->request_id, PyBytes_AsString(body), send_more_body,
                        self);
+  } else if (PyUnicode_CompareWithASCIIString(data_type,
+                                              "http.response.pathsend") == 0) {
+    PyObject *path = PyDict_GetItemString(data, "path");
+    if (!path || !PyUnicode_Check(path)) {
+      PyErr_SetString(PyExc_RuntimeError,
+                      "expected pathsend path to be a string");
+      return NULL;
+    }
+    asgi_send_path(self->request_id, (char *)PyUnicode_AsUTF8(path), self);
+  } else if (PyUnicode_CompareWithASCIIString(data_type,
+                                              "http.response.trailers") == 0) {
+    MapKeyVal *http_trailers =
+        AsgiHeaders_to_MapKeyVal(PyDict_GetItemString(data, "headers"));
+    if (!http_trailers) {
+      return NULL;
+    }
+    PyObject *more_trailers = PyDict_GetItemString(data, "more_trailers");
+    uint8_t send_more_trailers =
+        more_trailers && PyObject_IsTrue(more_trailers) == 1;
+    asgi_send_trailers(self->request_id, http_trailers, send_more_trailers,
+                       self);
+  } else if (PyUnicode_CompareWithASCIIString(
+                 data_type, "http.response.early_hint") == 0) {
+    PyObject *links = PyDict_GetItemString(data, "links");
+    PyObject *links_seq =
+        links ? PySequence_Fast(links, "expected links to be a sequence")
+              : PyTuple_New(0);
+    if (!links_seq) {
+      return NULL;
+    }
+    Py_ssize_t links_count = PySequence_Fast_GET_SIZE(links_seq);
+    size_t data_size = 0;
+    for (Py_ssize_t pos = 0; pos < links_count; pos++) {
+      PyObject *link = PySequence_Fast_GET_ITEM(links_seq, pos);
+      if (!PyBytes_Check(link)) {
+        PyErr_SetString(PyExc_RuntimeError, "expected links to be bytes");
+        Py_DECREF(links_seq);
+        return NULL;
+      }
+      data_size += sizeof("Link") + PyBytes_GET_SIZE(link) + 1;
+    }
+    MapKeyVal *http_links = MapKeyVal_new(links_count, data_size);
+    if (!http_links) {
+      Py_DECREF(links_seq);
+      return PyErr_NoMemory();
+    }
+    for (Py_ssize_t pos = 0; pos < links_count; pos++) {
+      PyObject *link = PySequence_Fast_GET_ITEM(links_seq, pos);
+      MapKeyVal_set(http_links, pos, "Link", sizeof("Link") - 1,
+                    PyBytes_AS_STRING(link), PyBytes_GET_SIZE(link));
+    }
+    Py_DECREF(links_seq);
+    asgi_send_early_hint(self->request_id, http_links, self);
   }
   Py_RETURN_NONE;
 }
@@ -660,6 +1433,10 @@ static PyMethodDef AsgiEvent_methods[] = {
      "method."},
     {"clear", (PyCFunction)AsgiEvent_clear, METH_VARARGS,
      "Clear ASGI Event, calls the underlying asnycio.Event clear() method."},
+    {"receive_wait", (PyCFunction)AsgiEvent_receive_wait, METH_VARARGS,
+     "Wait until data is received."},
+    {"receive_clear", (PyCFunction)AsgiEvent_receive_clear, METH_VARARGS,
+     "Clear the receive event."},
     {"receive_start", (PyCFunction)AsgiEvent_receive_start, METH_VARARGS,
      "Start reading receive data."},
     {"receive_end", (PyCFunction)AsgiEvent_receive_end, METH_VARARGS,
@@ -682,11 +1459,43 @@ static PyTypeObject AsgiEventType = {
     .tp_methods = AsgiEvent_methods,
 };
 
-void AsgiApp_handle_request(AsgiApp *app, uint64_t request_id, MapKeyVal *scope,
-                            MapKeyVal *headers, const char *client_host,
-                            int client_port, const char *server_host,
-                            int server_port) {
-  PyGILState_STATE gstate = PyGILState_Ensure();
+/*
+AsgiTls_new builds the scope for the ASGI TLS extension. Keys with integer
+values are converted, client_cert_chain may be repeated once per certificate.
+*/
+static PyObject *AsgiTls_new(MapKeyVal *tls_info) {
+  PyObject *tls = PyDict_New();
+  PyObject *client_cert_chain = PyList_New(0);
+  PyDict_SetItemString(tls, "server_cert", Py_None);
+  PyDict_SetItemString(tls, "client_cert_name", Py_None);
+  PyDict_SetItemString(tls, "client_cert_error", Py_None);
+  for (size_t i = 0; i < tls_info->count; i++) {
+    const char *key = tls_info->keys[i];
+    PyObject *value;
+    if (strcmp(key, "tls_version") == 0 || strcmp(key, "cipher_suite") == 0) {
+      value = PyLong_FromString(tls_info->values[i], NULL, 10);
+    } else {
+      value = PyUnicode_FromString(tls_info->values[i]);
+    }
+    if (strcmp(key, "client_cert_chain") == 0) {
+      PyList_Append(client_cert_chain, value);
+    } else {
+      PyDict_SetItemString(tls, key, value);
+    }
+    Py_DECREF(value);
+  }
+  PyDict_SetItemString(tls, "client_cert_chain", client_cert_chain);
+  Py_DECREF(client_cert_chain);
+  return tls;
+}
+
+AsgiEvent *AsgiApp_handle_request(AsgiApp *app, uint64_t request_id,
+                                  MapKeyVal *scope, MapKeyVal *headers,
+                                  const char *client_host, int client_port,
+                                  const char *server_host, int server_port,
+                                  MapKeyVal *tls_info) {
+  TimedGil gil;
+  TimedGil_ensure(&gil, "asgi");
 
   PyObject *scope_dict = PyDict_New();
   PyDict_SetItemString(scope_dict, "asgi", asgi_version);
@@ -716,17 +1525,34 @@ void AsgiApp_handle_request(AsgiApp *app, uint64_t request_id, MapKeyVal *scope,
   PyDict_SetItemString(scope_dict, "headers", headers_tuple);
   Py_DECREF(headers_tuple);
 
-  PyObject *client_tuple = PyTuple_New(2);
-  PyTuple_SetItem(client_tuple, 0, PyUnicode_FromString(client_host));
-  PyTuple_SetItem(client_tuple, 1, PyLong_FromLong(client_port));
-  PyDict_SetItemString(scope_dict, "client", client_tuple);
-  Py_DECREF(client_tuple);
+  if (client_host) {
+    PyObject *client_tuple = PyTuple_New(2);
+    PyTuple_SetItem(client_tuple, 0, PyUnicode_FromString(client_host));
+    PyTuple_SetItem(client_tuple, 1, PyLong_FromLong(client_port));
+    PyDict_SetItemString(scope_dict, "client", client_tuple);
+    Py_DECREF(client_tuple);
+  } else {
+    PyDict_SetItemString(scope_dict, "client", Py_None);
+  }
+
+  if (server_host) {
+    PyObject *server_tuple = PyTuple_New(2);
+    PyTuple_SetItem(server_tuple, 0, PyUnicode_FromString(server_host));
+    PyTuple_SetItem(server_tuple, 1, PyLong_FromLong(server_port));
+    PyDict_SetItemString(scope_dict, "server", server_tuple);
+    Py_DECREF(server_tuple);
+  } else {
+    PyDict_SetItemString(scope_dict, "server", Py_None);
+  }
 
-  PyObject *server_tuple = PyTuple_New(2);
-  PyTuple_SetItem(server_tuple, 0, PyUnicode_FromString(server_host));
-  PyTuple_SetItem(server_tuple, 1, PyLong_FromLong(server_port));
-  PyDict_SetItemString(scope_dict, "server", server_tuple);
-  Py_DECREF(server_tuple);
+  PyObject *extensions = PyDict_Copy(asgi_extensions);
+  if (tls_info) {
+    PyObject *tls = AsgiTls_new(tls_info);
+    PyDict_SetItemString(extensions, "tls", tls);
+    Py_DECREF(tls);
+  }
+  PyDict_SetItemString(scope_dict, "extensions", extensions);
+  Py_DECREF(extensions);
 
   PyObject *state = PyDict_Copy(app->state);
   PyDict_SetItemString(scope_dict, "state", state);
@@ -739,12 +1565,15 @@ void AsgiApp_handle_request(AsgiApp *app, uint64_t request_id, MapKeyVal *scope,
 #if PY_MINOR_VERSION == 9
   PyObject *noargs = PyTuple_New(0);
   PyObject *kwargs = PyDict_New();
-  PyDict_SetItemString(kwargs, "loop", asyncio_Loop);
+  PyDict_SetItemString(kwargs, "loop", atomic_load(&asyncio_Loop));
   asgi_event->event_ts = PyObject_Call(asyncio_Event_ts, noargs, kwargs);
+  asgi_event->receive_event_ts =
+      PyObject_Call(asyncio_Event_ts, noargs, kwargs);
   Py_DECREF(kwargs);
   Py_DECREF(noargs);
 #else
   asgi_event->event_ts = PyObject_CallNoArgs(asyncio_Event_ts);
+  asgi_event->receive_event_ts = PyObject_CallNoArgs(asyncio_Event_ts);
 #endif
 
   PyObject *receive =
@@ -755,28 +1584,35 @@ void AsgiApp_handle_request(AsgiApp *app, uint64_t request_id, MapKeyVal *scope,
   PyTuple_SetItem(args, 0, scope_dict);
   PyTuple_SetItem(args, 1, receive);
   PyTuple_SetItem(args, 2, send);
-  PyObject *coro = PyObject_Call(app->handler, args, NULL);
+  PyObject *handler = App_get_handler(&app->handler, app->handler_lock);
+  PyObject *coro = PyObject_Call(handler, args, NULL);
+  Py_DECREF(handler);
   Py_DECREF(args);
 
-  Py_INCREF(asyncio_Loop);
+  PyObject *loop = atomic_load(&asyncio_Loop);
+  Py_INCREF(loop);
   args = PyTuple_New(2);
   PyTuple_SetItem(args, 0, coro);
-  PyTuple_SetItem(args, 1, asyncio_Loop);
-  asgi_event->future =
+  PyTuple_SetItem(args, 1, loop);
+  PyObject *future =
       PyObject_Call(asyncio_run_coroutine_threadsafe, args, NULL);
   Py_DECREF(args);
+  Py_BEGIN_CRITICAL_SECTION(asgi_event);
+  asgi_event->future = future;
+  Py_END_CRITICAL_SECTION();
 
   PyObject *add_done_callback =
-      PyObject_GetAttrString(asgi_event->future, "add_done_callback");
+      PyObject_GetAttrString(future, "add_done_callback");
   PyObject *asgi_event_result =
       PyObject_GetAttrString((PyObject *)asgi_event, "result");
   PyObject_CallOneArg(add_done_callback, asgi_event_result);
   Py_DECREF(add_done_callback);
   Py_DECREF(asgi_event_result);
 
-  Py_DECREF(asgi_event);
+  // The reference to asgi_event is kept until Go calls AsgiEvent_cleanup
 
-  PyGILState_Release(gstate);
+  TimedGil_release(&gil);
+  return asgi_event;
 }
 
 void AsgiApp_cleanup(AsgiApp *app) {
@@ -785,11 +1621,209 @@ void AsgiApp_cleanup(AsgiApp *app) {
   Py_XDECREF(app->state);
   Py_XDECREF(app->lifespan_shutdown);
   PyGILState_Release(gstate);
+  PyThread_free_lock(app->handler_lock);
   free(app);
 }
 
 // Initialization
 
+/*
+Py_set_environ sets environment variables through os.environ, so they're seen
+by Python code that read it at startup and, through putenv, by C libraries.
+*/
+void Py_set_environ(MapKeyVal *env) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  PyObject *os = PyImport_ImportModule("os");
+  PyObject *environ = os ? PyObject_GetAttrString(os, "environ") : NULL;
+  for (size_t i = 0; environ && i < env->count; i++) {
+    PyObject *value = PyUnicode_FromString(env->values[i]);
+    if (!value || PyMapping_SetItemString(environ, env->keys[i], value) < 0) {
+      PyErr_Print();
+    }
+    Py_XDECREF(value);
+  }
+  if (PyErr_Occurred()) {
+    PyErr_Print();
+  }
+  Py_XDECREF(environ);
+  Py_XDECREF(os);
+  PyGILState_Release(gstate);
+}
+
+/*
+Py_prepend_sys_path inserts path at the start of sys.path, like PYTHONPATH does,
+unless it's already there.
+*/
+void Py_prepend_sys_path(const char *path) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  PyObject *sys_path = PySys_GetObject("path");
+  PyObject *entry = PyUnicode_FromString(path);
+  if (sys_path && entry && PySequence_Contains(sys_path, entry) == 0) {
+    PyList_Insert(sys_path, 0, entry);
+  }
+  if (PyErr_Occurred()) {
+    PyErr_Print();
+  }
+  Py_XDECREF(entry);
+  PyGILState_Release(gstate);
+}
+
+/*
+Py_read_project_config returns the [tool.caddy-snake] table of the
+pyproject.toml in path. Returns NULL if it can't be read, the error is printed.
+*/
+MapKeyVal *Py_read_project_config(const char *path) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  MapKeyVal *config = NULL;
+  PyObject *pairs = PyObject_CallFunction(read_project_config, "s", path);
+  if (pairs) {
+    config = MapKeyVal_from_pairs(pairs, 0, "expected pairs of strings");
+    Py_DECREF(pairs);
+  }
+  if (!config) {
+    PyErr_Print();
+  }
+  PyGILState_Release(gstate);
+  return config;
+}
+
+/*
+Py_dump_stacks returns the stacks of all Python threads and of the tasks
+running in the ASGI event loop. The result must be released with free, it's
+NULL if the stacks can't be dumped.
+*/
+char *Py_dump_stacks(void) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  char *stacks = NULL;
+  PyObject *loop = atomic_load(&asyncio_Loop);
+  if (!loop) {
+    loop = Py_None;
+  }
+  PyObject *result = PyObject_CallOneArg(dump_stacks, loop);
+  if (result) {
+    const char *str = PyUnicode_AsUTF8(result);
+    if (str) {
+      stacks = strdup(str);
+    }
+    Py_DECREF(result);
+  }
+  if (PyErr_Occurred()) {
+    PyErr_Print();
+  }
+  PyGILState_Release(gstate);
+  return stacks;
+}
+
+/*
+Py_memory_profile runs a tracemalloc command: "start", "stop" or "stats".
+modules is a newline separated list of the apps to report allocations for.
+Returns the result as JSON, it must be released with free. It's NULL if the
+command fails.
+*/
+char *Py_memory_profile(const char *command, const char *modules, int limit) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  char *profile = NULL;
+  PyObject *result =
+      PyObject_CallFunction(memory_profile, "ssi", command, modules, limit);
+  if (result) {
+    const char *str = PyUnicode_AsUTF8(result);
+    if (str) {
+      profile = strdup(str);
+    }
+    Py_DECREF(result);
+  }
+  if (PyErr_Occurred()) {
+    PyErr_Print();
+  }
+  PyGILState_Release(gstate);
+  return profile;
+}
+
+/*
+Py_health_check returns 1 when the interpreter responds and the callable named
+by target (module:callable) returns a truthy value. target can be empty to only
+check the interpreter. Returns 0 otherwise.
+*/
+int Py_health_check(const char *target) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  int healthy = 0;
+  PyObject *result = PyObject_CallFunction(health_check, "s", target);
+  if (result) {
+    healthy = PyObject_IsTrue(result) == 1;
+    Py_DECREF(result);
+  }
+  if (PyErr_Occurred()) {
+    PyErr_Print();
+  }
+  PyGILState_Release(gstate);
+  return healthy;
+}
+
+/*
+Py_shell runs command, or an interactive console when it's NULL, with the app
+named by target (module:app) imported as `app`. target can be empty to not
+import an app. packages_path is added to sys.path when it isn't NULL. Returns
+the exit code.
+*/
+int Py_shell(const char *command, const char *target,
+             const char *packages_path) {
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  int exit_code = 1;
+  PyObject *result =
+      PyObject_CallFunction(shell, "zsz", command, target, packages_path);
+  if (result) {
+    exit_code = PyLong_AsLong(result);
+    Py_DECREF(result);
+  }
+  if (PyErr_Occurred()) {
+    PyErr_Print();
+  }
+  PyGILState_Release(gstate);
+  return exit_code;
+}
+
+/*
+Py_minor_version returns the minor version of the Python that's embedded.
+*/
+int Py_minor_version(void) { return PY_MINOR_VERSION; }
+
+/*
+Py_is_free_threaded returns 1 when built against a free-threaded Python.
+*/
+int Py_is_free_threaded(void) {
+#ifdef Py_GIL_DISABLED
+  return 1;
+#else
+  return 0;
+#endif
+}
+
+/*
+Py_is_gil_enabled returns 1 when the GIL is enabled. A free-threaded Python
+enables it at runtime when an extension module without free-threading
+support is imported, or when PYTHON_GIL=1 is set.
+*/
+int Py_is_gil_enabled(void) {
+#ifdef Py_GIL_DISABLED
+  PyGILState_STATE gstate = PyGILState_Ensure();
+  int enabled = 1;
+  PyObject *is_gil_enabled = PySys_GetObject("_is_gil_enabled");
+  if (is_gil_enabled) {
+    PyObject *result = PyObject_CallNoArgs(is_gil_enabled);
+    if (result) {
+      enabled = PyObject_IsTrue(result);
+      Py_DECREF(result);
+    } else {
+      PyErr_Clear();
+    }
+  }
+  PyGILState_Release(gstate);
+  return enabled;
+#else
+  return 1;
+#endif
+}
+
 void Py_init_and_release_gil(const char *setup_py) {
   PyStatus status;
   PyConfig config;
@@ -809,21 +1843,23 @@ void Py_init_and_release_gil(const char *setup_py) {
   PyObject *sysPath = PySys_GetObject("path");
   PyList_Insert(sysPath, 0, PyUnicode_FromString(""));
 
-  // Used for turning bytes-like object into a file-like object
-  PyObject *io_module = PyImport_ImportModule("io");
-  BytesIO = PyObject_GetAttrString(io_module, "BytesIO");
-
-  // Used for events
+  // Used for events, the loop is created by Asgi_start_event_loop
   PyObject *asyncio = PyImport_ImportModule("asyncio");
-  PyObject *loop_name = PyUnicode_FromString("new_event_loop");
-  asyncio_Loop = PyObject_CallMethodNoArgs(asyncio, loop_name);
-  Py_DECREF(loop_name);
   asyncio_run_coroutine_threadsafe =
       PyObject_GetAttrString(asyncio, "run_coroutine_threadsafe");
 
   PyObject *caddysnake_module = PyModule_Create(&CaddysnakeModule);
+#ifdef Py_GIL_DISABLED
+  // The bridge doesn't rely on the GIL, see Py_BEGIN_CRITICAL_SECTION above
+  PyUnstable_Module_SetGIL(caddysnake_module, Py_MOD_GIL_NOT_USED);
+#endif
   PyObject *response_callback_fn =
       PyObject_GetAttrString(caddysnake_module, "response_callback");
+  PyObject *read_body_fn =
+      PyObject_GetAttrString(caddysnake_module, "read_body");
+  PyObject *log_fn = PyObject_GetAttrString(caddysnake_module, "log");
+  PyObject *log_record_fn =
+      PyObject_GetAttrString(caddysnake_module, "log_record");
 
   // Initialize types
   PyType_Ready(&ResponseType);
@@ -833,44 +1869,112 @@ void Py_init_and_release_gil(const char *setup_py) {
   PyRun_SimpleString(setup_py);
   PyObject *main_module = PyImport_AddModule("__main__");
 
-  // WSGI: Setup task queue and consumer threads
+  // Send Python stderr to the Caddy logger
+  PyObject *logging_setup_fn =
+      PyObject_GetAttrString(main_module, "caddysnake_setup_logging");
+  PyObject *logging_setup_result = PyObject_CallFunctionObjArgs(
+      logging_setup_fn, log_fn, log_record_fn, NULL);
+  current_request_id = PyTuple_GetItem(logging_setup_result, 0);
+  log_writer = PyTuple_GetItem(logging_setup_result, 1);
+  format_exception = PyTuple_GetItem(logging_setup_result, 2);
+  PyRun_SimpleString("del caddysnake_setup_logging");
+
+  // Used to tell ASGI and WSGI apps apart
+  PyObject *interface_setup_fn =
+      PyObject_GetAttrString(main_module, "caddysnake_setup_interface");
+  is_asgi_app = PyObject_CallNoArgs(interface_setup_fn);
+  PyRun_SimpleString("del caddysnake_setup_interface");
+
+  // Used to read [tool.caddy-snake] from pyproject.toml
+  PyObject *project_setup_fn =
+      PyObject_GetAttrString(main_module, "caddysnake_setup_project");
+  read_project_config = PyObject_CallNoArgs(project_setup_fn);
+  PyRun_SimpleString("del caddysnake_setup_project");
+
+  // Used to import apps again on reload
+  PyObject *reload_setup_fn =
+      PyObject_GetAttrString(main_module, "caddysnake_setup_reload");
+  reload_app = PyObject_CallNoArgs(reload_setup_fn);
+  PyRun_SimpleString("del caddysnake_setup_reload");
+
+  // Used to debug hung requests
+  PyObject *debug_setup_fn =
+      PyObject_GetAttrString(main_module, "caddysnake_setup_debug");
+  dump_stacks = PyObject_CallNoArgs(debug_setup_fn);
+  PyRun_SimpleString("del caddysnake_setup_debug");
+
+  // Used to chase memory growth
+  PyObject *memory_setup_fn =
+      PyObject_GetAttrString(main_module, "caddysnake_setup_memory");
+  memory_profile = PyObject_CallNoArgs(memory_setup_fn);
+  PyRun_SimpleString("del caddysnake_setup_memory");
+
+  // Used by the health endpoints
+  PyObject *health_setup_fn =
+      PyObject_GetAttrString(main_module, "caddysnake_setup_health");
+  health_check = PyObject_CallNoArgs(health_setup_fn);
+  PyRun_SimpleString("del caddysnake_setup_health");
+
+  // Used by the python-shell command
+  PyObject *shell_setup_fn =
+      PyObject_GetAttrString(main_module, "caddysnake_setup_shell");
+  shell = PyObject_CallNoArgs(shell_setup_fn);
+  PyRun_SimpleString("del caddysnake_setup_shell");
+
+  // WSGI: Setup task queue, consumer threads are started by Wsgi_start_threads
   PyObject *wsgi_setup_fn =
       PyObject_GetAttrString(main_module, "caddysnake_setup_wsgi");
-  PyObject *task_queue =
-      PyObject_CallOneArg(wsgi_setup_fn, response_callback_fn);
+  PyObject *wsgi_setup_result = PyObject_CallFunctionObjArgs(
+      wsgi_setup_fn, response_callback_fn, read_body_fn, NULL);
+  PyObject *task_queue = PyTuple_GetItem(wsgi_setup_result, 0);
   task_queue_put = PyObject_GetAttrString(task_queue, "put");
+  build_wsgi_input = PyTuple_GetItem(wsgi_setup_result, 1);
+  wsgi_file_wrapper = PyTuple_GetItem(wsgi_setup_result, 2);
+  wsgi_start_threads = PyTuple_GetItem(wsgi_setup_result, 3);
   PyRun_SimpleString("del caddysnake_setup_wsgi");
   // Setup WSGI version
   wsgi_version = PyTuple_New(2);
   PyTuple_SetItem(wsgi_version, 0, PyLong_FromLong(1));
   PyTuple_SetItem(wsgi_version, 1, PyLong_FromLong(0));
 
-  // Setup stderr for logging
-  sys_stderr = PySys_GetObject("stderr");
-
   // ASGI: Setup wrappers for asyncio events
   PyObject *asgi_setup_fn =
       PyObject_GetAttrString(main_module, "caddysnake_setup_asgi");
-  PyObject *asgi_setup_result =
-      PyObject_CallOneArg(asgi_setup_fn, asyncio_Loop);
+  PyObject *asgi_setup_result = PyObject_CallNoArgs(asgi_setup_fn);
   asyncio_Event_ts = PyTuple_GetItem(asgi_setup_result, 0);
   build_receive = PyTuple_GetItem(asgi_setup_result, 1);
   build_send = PyTuple_GetItem(asgi_setup_result, 2);
   build_lifespan = PyTuple_GetItem(asgi_setup_result, 3);
+  start_event_loop = PyTuple_GetItem(asgi_setup_result, 4);
+  set_executor_threads = PyTuple_GetItem(asgi_setup_result, 5);
   PyRun_SimpleString("del caddysnake_setup_asgi");
   // Setup ASGI version
   asgi_version = PyDict_New();
   PyDict_SetItemString(asgi_version, "version", PyUnicode_FromString("3.0"));
   PyDict_SetItemString(asgi_version, "spec_version",
                        PyUnicode_FromString("2.3"));
+  // Setup ASGI extensions supported by the server
+  asgi_extensions = PyDict_New();
+  PyObject *pathsend = PyDict_New();
+  PyDict_SetItemString(asgi_extensions, "http.response.pathsend", pathsend);
+  Py_DECREF(pathsend);
+  PyObject *trailers = PyDict_New();
+  PyDict_SetItemString(asgi_extensions, "http.response.trailers", trailers);
+  Py_DECREF(trailers);
+  PyObject *early_hint = PyDict_New();
+  PyDict_SetItemString(asgi_extensions, "http.response.early_hint",
+                       early_hint);
+  Py_DECREF(early_hint);
 
   // This are global objects expected to exist during the entire program
   // lifetime. Refcounts can be safely decreased, but there's no need to do it
   // because we expect the objects to stick around forever.
-  // Py_DECREF(task_queue);
+  // Py_DECREF(wsgi_setup_result);
   // Py_DECREF(wsgi_setup_fn);
   // Py_DECREF(response_callback_fn);
-  // Py_DECREF(io_module);
+  // Py_DECREF(read_body_fn);
+  // Py_DECREF(log_fn);
+  // Py_DECREF(logging_setup_result);
   // Py_DECREF(caddysnake_module);
 
   PyEval_ReleaseThread(PyGILState_GetThisThreadState());
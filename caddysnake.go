@@ -5,28 +5,51 @@ package caddysnake
 // #include "caddysnake.h"
 import "C"
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
-	"net/textproto"
+	"net/netip"
 	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 //go:embed caddysnake.py
@@ -36,16 +59,93 @@ var caddysnake_py string
 type AppServer interface {
 	Cleanup() error
 	HandleRequest(w http.ResponseWriter, r *http.Request) error
+	stats() *appStats
+}
+
+// appStats holds the state of an app reported by the admin API
+type appStats struct {
+	module    string
+	venv_path string
+	// Unix time in nanoseconds when the app was imported or reloaded
+	loaded_at atomic.Int64
+	reloads   atomic.Int64
+	requests  atomic.Int64
+	in_flight atomic.Int64
+	errors    atomic.Int64
+	// Project directory to install dependencies from before a reload, when auto_install
+	// is on
+	install_dir atomic.Value
+}
+
+func newAppStats(module string, venv_path string) *appStats {
+	stats := &appStats{module: module, venv_path: venv_path}
+	stats.loaded_at.Store(time.Now().UnixNano())
+	return stats
+}
+
+// reloaded records a successful reload
+func (s *appStats) reloaded() {
+	s.loaded_at.Store(time.Now().UnixNano())
+	s.reloads.Add(1)
 }
 
 // CaddySnake module that communicates with a Python app
 type CaddySnake struct {
-	ModuleWsgi string `json:"module_wsgi,omitempty"`
-	ModuleAsgi string `json:"module_asgi,omitempty"`
-	Lifespan   string `json:"lifespan,omitempty"`
-	VenvPath   string `json:"venv_path,omitempty"`
-	logger     *zap.Logger
-	app        AppServer
+	ModuleWsgi           string            `json:"module_wsgi,omitempty"`
+	ModuleAsgi           string            `json:"module_asgi,omitempty"`
+	Module               string            `json:"module,omitempty"`
+	Project              string            `json:"project,omitempty"`
+	Archive              string            `json:"archive,omitempty"`
+	Mounts               []Mount           `json:"mounts,omitempty"`
+	Hosts                []HostApp         `json:"hosts,omitempty"`
+	Lifespan             string            `json:"lifespan,omitempty"`
+	VenvPath             string            `json:"venv_path,omitempty"`
+	PythonPath           []string          `json:"python_path,omitempty"`
+	AutoInstall          string            `json:"auto_install,omitempty"`
+	WatchDependencies    string            `json:"watch_dependencies,omitempty"`
+	RootPath             string            `json:"root_path,omitempty"`
+	RequestBodyChunkSize int               `json:"request_body_chunk_size,omitempty"`
+	Timeout              caddy.Duration    `json:"timeout,omitempty"`
+	SpoolThreshold       int64             `json:"request_body_spool_threshold,omitempty"`
+	MaxRequestBody       int64             `json:"max_request_body,omitempty"`
+	TrustedProxies       []string          `json:"trusted_proxies,omitempty"`
+	WsgiThreads          int               `json:"wsgi_threads,omitempty"`
+	EventLoop            string            `json:"event_loop,omitempty"`
+	AsgiExecutorThreads  int               `json:"asgi_executor_threads,omitempty"`
+	Env                  map[string]string `json:"env,omitempty"`
+	HealthPath           string            `json:"health_path,omitempty"`
+	HealthCheck          string            `json:"health_check,omitempty"`
+	DjangoMigrate        string            `json:"django_migrate,omitempty"`
+	DjangoCollectstatic  string            `json:"django_collectstatic,omitempty"`
+	OnStartup            [][]string        `json:"on_startup,omitempty"`
+	logger               *zap.Logger
+	app                  AppServer
+	mounts               []mountedApp
+	hosts                map[string]mountedApp
+	trusted_proxies      []netip.Prefix
+	project_dir          string
+	config_ctx           context.Context
+	stop_watching        func()
+}
+
+// Mount serves an app under a path prefix of the handler
+type Mount struct {
+	PathPrefix string `json:"path_prefix"`
+	Module     string `json:"module"`
+}
+
+// mountedApp is an app imported for a mount or host. prefix is empty for hosts.
+type mountedApp struct {
+	prefix string
+	module string
+	app    AppServer
+}
+
+// HostApp serves an app for requests to a host name. Host can start with "*." to match
+// any subdomain.
+type HostApp struct {
+	Host   string `json:"host"`
+	Module string `json:"module"`
 }
 
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler.
@@ -65,120 +165,2043 @@ func (f *CaddySnake) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					if !d.Args(&f.ModuleWsgi) {
 						return d.Errf("expected exactly one argument for module_wsgi")
 					}
+				case "project":
+					if !d.Args(&f.Project) {
+						return d.Errf("expected exactly one argument for project")
+					}
+				case "archive":
+					if !d.Args(&f.Archive) {
+						return d.Errf("expected exactly one argument for archive")
+					}
+				case "mount":
+					var mount Mount
+					if !d.Args(&mount.PathPrefix, &mount.Module) {
+						return d.Errf("expected exactly two arguments for mount: <path_prefix> <module:app>")
+					}
+					f.Mounts = append(f.Mounts, mount)
+				case "host":
+					var host HostApp
+					if !d.Args(&host.Host, &host.Module) {
+						return d.Errf("expected exactly two arguments for host: <host> <module:app>")
+					}
+					f.Hosts = append(f.Hosts, host)
+				case "module":
+					if !d.Args(&f.Module) {
+						return d.Errf("expected exactly one argument for module")
+					}
 				case "lifespan":
 					if !d.Args(&f.Lifespan) || (f.Lifespan != "on" && f.Lifespan != "off") {
 						return d.Errf("expected exactly one argument for lifespan: on|off")
 					}
+				case "auto_install":
+					if !d.Args(&f.AutoInstall) || (f.AutoInstall != "on" && f.AutoInstall != "off") {
+						return d.Errf("expected exactly one argument for auto_install: on|off")
+					}
+				case "watch_dependencies":
+					if !d.Args(&f.WatchDependencies) || (f.WatchDependencies != "on" && f.WatchDependencies != "off") {
+						return d.Errf("expected exactly one argument for watch_dependencies: on|off")
+					}
+				case "django_migrate":
+					if !d.Args(&f.DjangoMigrate) || (f.DjangoMigrate != "on" && f.DjangoMigrate != "off") {
+						return d.Errf("expected exactly one argument for django_migrate: on|off")
+					}
+				case "django_collectstatic":
+					if !d.Args(&f.DjangoCollectstatic) || (f.DjangoCollectstatic != "on" && f.DjangoCollectstatic != "off") {
+						return d.Errf("expected exactly one argument for django_collectstatic: on|off")
+					}
+				case "on_startup":
+					command := d.RemainingArgs()
+					if len(command) == 0 {
+						return d.Errf("expected a command for on_startup")
+					}
+					f.OnStartup = append(f.OnStartup, command)
+				case "event_loop":
+					if !d.Args(&f.EventLoop) || (f.EventLoop != "auto" && f.EventLoop != "asyncio" && f.EventLoop != "uvloop") {
+						return d.Errf("expected exactly one argument for event_loop: auto|asyncio|uvloop")
+					}
+				case "env":
+					var key, value string
+					if !d.Args(&key, &value) {
+						return d.Errf("expected exactly two arguments for env: KEY value")
+					}
+					if f.Env == nil {
+						f.Env = map[string]string{}
+					}
+					f.Env[key] = value
 				case "venv":
 					if !d.Args(&f.VenvPath) {
 						return d.Errf("expected exactly one argument for venv")
 					}
+				case "python_path":
+					var dir string
+					if !d.Args(&dir) {
+						return d.Errf("expected exactly one argument for python_path")
+					}
+					f.PythonPath = append(f.PythonPath, dir)
+				case "root_path":
+					if !d.Args(&f.RootPath) {
+						return d.Errf("expected exactly one argument for root_path")
+					}
+				case "request_body_chunk_size":
+					chunk_size, err := parseByteSize(d)
+					if err != nil {
+						return err
+					}
+					if chunk_size > math.MaxInt32 {
+						return d.Errf("invalid request_body_chunk_size: %d", chunk_size)
+					}
+					f.RequestBodyChunkSize = int(chunk_size)
+				case "request_body_spool_threshold":
+					threshold, err := parseByteSize(d)
+					if err != nil {
+						return err
+					}
+					f.SpoolThreshold = int64(threshold)
+				case "max_request_body":
+					max_size, err := parseByteSize(d)
+					if err != nil {
+						return err
+					}
+					f.MaxRequestBody = int64(max_size)
+				case "wsgi_threads":
+					count, err := parseThreadCount(d)
+					if err != nil {
+						return err
+					}
+					f.WsgiThreads = count
+				case "asgi_executor_threads":
+					count, err := parseThreadCount(d)
+					if err != nil {
+						return err
+					}
+					f.AsgiExecutorThreads = count
+				case "trusted_proxies":
+					ranges := d.RemainingArgs()
+					if len(ranges) == 0 {
+						return d.ArgErr()
+					}
+					f.TrustedProxies = append(f.TrustedProxies, ranges...)
+				case "health_path":
+					if !d.Args(&f.HealthPath) {
+						return d.Errf("expected exactly one argument for health_path")
+					}
+				case "health_check":
+					if !d.Args(&f.HealthCheck) {
+						return d.Errf("expected exactly one argument for health_check")
+					}
+				case "timeout":
+					var timeout string
+					if !d.Args(&timeout) {
+						return d.Errf("expected exactly one argument for timeout")
+					}
+					dur, err := caddy.ParseDuration(timeout)
+					if err != nil || dur <= 0 {
+						return d.Errf("invalid timeout: %s", timeout)
+					}
+					f.Timeout = caddy.Duration(dur)
 				default:
 					return d.Errf("unknown subdirective: %s", d.Val())
 				}
 			}
-		} else {
-			return d.ArgErr()
+		} else {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+// parseByteSize parses the argument of a subdirective with a human readable size like 64KB
+func parseByteSize(d *caddyfile.Dispenser) (uint64, error) {
+	name := d.Val()
+	var size string
+	if !d.Args(&size) {
+		return 0, d.Errf("expected exactly one argument for %s", name)
+	}
+	value, err := humanize.ParseBytes(size)
+	if err != nil || value == 0 || value > math.MaxInt64 {
+		return 0, d.Errf("invalid %s: %s", name, size)
+	}
+	return value, nil
+}
+
+// parseThreadCount parses the argument of a subdirective with a number of threads
+func parseThreadCount(d *caddyfile.Dispenser) (int, error) {
+	name := d.Val()
+	var threads string
+	if !d.Args(&threads) {
+		return 0, d.Errf("expected exactly one argument for %s", name)
+	}
+	count, err := strconv.Atoi(threads)
+	if err != nil || count <= 0 {
+		return 0, d.Errf("invalid %s: %s", name, threads)
+	}
+	return count, nil
+}
+
+// privateRanges are the networks trusted when trusted_proxies is set to private_ranges
+var privateRanges = []string{
+	"192.168.0.0/16",
+	"172.16.0.0/12",
+	"10.0.0.0/8",
+	"127.0.0.1/8",
+	"fd00::/8",
+	"::1",
+}
+
+// parseTrustedProxies parses the trusted_proxies ranges, which can be CIDRs, single IPs
+// or the private_ranges shortcut.
+func parseTrustedProxies(ranges []string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, value := range ranges {
+		if value == "private_ranges" {
+			expanded, err := parseTrustedProxies(privateRanges)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, expanded...)
+			continue
+		}
+		if strings.Contains(value, "/") {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted_proxies range: %s", value)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted_proxies range: %s", value)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// CaddyModule returns the Caddy module information.
+func (CaddySnake) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.python",
+		New: func() caddy.Module { return new(CaddySnake) },
+	}
+}
+
+// Provision sets up the module.
+func (f *CaddySnake) Provision(ctx caddy.Context) error {
+	f.logger = ctx.Logger(f)
+	// Stopped in Cleanup, which caddy also calls when provisioning fails
+	stacks_signal.start()
+	reload_signal.start()
+	trusted_proxies, err := parseTrustedProxies(f.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	f.trusted_proxies = trusted_proxies
+	f.config_ctx = ctx.Context
+	venv_path, err := f.prepareInterpreter()
+	if err != nil {
+		return err
+	}
+	if err := f.runStartupCommands(venv_path); err != nil {
+		return err
+	}
+	if f.Module != "" {
+		if f.ModuleWsgi != "" || f.ModuleAsgi != "" {
+			return errors.New("module can't be used together with module_wsgi or module_asgi")
+		}
+		is_asgi, err := detectInterface(f.Module, venv_path)
+		if err != nil {
+			return err
+		}
+		if is_asgi {
+			f.ModuleAsgi = f.Module
+		} else {
+			f.ModuleWsgi = f.Module
+		}
+		f.logger.Info("detected app interface", zap.String("module", f.Module), zap.Bool("asgi", is_asgi))
+	}
+	if f.ModuleWsgi != "" {
+		if f.Lifespan != "" {
+			f.logger.Warn("lifespan is only used in ASGI mode", zap.String("lifespan", f.Lifespan))
+		}
+		if f.EventLoop != "" {
+			f.logger.Warn("event_loop is only used in ASGI mode", zap.String("event_loop", f.EventLoop))
+		}
+		if f.AsgiExecutorThreads != 0 {
+			f.logger.Warn("asgi_executor_threads is only used in ASGI mode", zap.Int("asgi_executor_threads", f.AsgiExecutorThreads))
+		}
+		f.app, err = f.importApp(f.ModuleWsgi, false, venv_path)
+		if err != nil {
+			return err
+		}
+		f.logger.Info("imported wsgi app", zap.String("module_wsgi", f.ModuleWsgi), zap.String("venv_path", venv_path))
+	} else if f.ModuleAsgi != "" {
+		if f.WsgiThreads != 0 {
+			f.logger.Warn("wsgi_threads is only used in WSGI mode", zap.Int("wsgi_threads", f.WsgiThreads))
+		}
+		f.app, err = f.importApp(f.ModuleAsgi, true, venv_path)
+		if err != nil {
+			return err
+		}
+	}
+	for _, mount := range f.Mounts {
+		app, err := f.detectAndImportApp(mount.Module, venv_path)
+		if err != nil {
+			return fmt.Errorf("mount %s: %w", mount.PathPrefix, err)
+		}
+		f.mounts = append(f.mounts, mountedApp{strings.TrimSuffix(mount.PathPrefix, "/"), mount.Module, app})
+		f.logger.Info("mounted app", zap.String("path_prefix", mount.PathPrefix), zap.String("module", mount.Module))
+	}
+	// Longest prefixes first, so nested mounts take precedence
+	sort.SliceStable(f.mounts, func(i, j int) bool {
+		return len(f.mounts[i].prefix) > len(f.mounts[j].prefix)
+	})
+	if len(f.Hosts) > 0 {
+		f.hosts = map[string]mountedApp{}
+	}
+	for _, host := range f.Hosts {
+		app, err := f.detectAndImportApp(host.Module, venv_path)
+		if err != nil {
+			return fmt.Errorf("host %s: %w", host.Host, err)
+		}
+		f.hosts[strings.ToLower(host.Host)] = mountedApp{"", host.Module, app}
+		f.logger.Info("imported app for host", zap.String("host", host.Host), zap.String("module", host.Module))
+	}
+	if f.WatchDependencies == "on" {
+		modules := []string{}
+		if f.app != nil {
+			modules = append(modules, f.ModuleWsgi+f.ModuleAsgi)
+		}
+		for _, mount := range f.Mounts {
+			modules = append(modules, mount.Module)
+		}
+		for _, host := range f.Hosts {
+			modules = append(modules, host.Module)
+		}
+		f.stop_watching = watchDependencies(f.logger, f.project_dir, modules)
+	}
+	warnIfGilEnabled(f.logger)
+	return nil
+}
+
+// detectAndImportApp imports an app after detecting whether it's ASGI or WSGI
+func (f *CaddySnake) detectAndImportApp(pattern string, venv_path string) (AppServer, error) {
+	is_asgi, err := detectInterface(pattern, venv_path)
+	if err != nil {
+		return nil, err
+	}
+	return f.importApp(pattern, is_asgi, venv_path)
+}
+
+// prepareInterpreter sets up the environment and sys.path the app is imported with and
+// returns the venv to use, installing its dependencies if needed
+func (f *CaddySnake) prepareInterpreter() (string, error) {
+	f.project_dir = "."
+	if f.Project != "" {
+		f.project_dir = f.Project
+		if err := f.loadProjectConfig(); err != nil {
+			return "", err
+		}
+	}
+	if len(f.Env) > 0 {
+		if name, value := python_env.claim(f.config_ctx, f.Env); name != "" {
+			return "", fmt.Errorf("env %s is already set to %q by another python block, environment variables are shared by all apps", name, value)
+		}
+		// Set before importing the app, settings modules usually read them at import time
+		setPythonEnv(f.Env)
+	}
+	modules := pythonPathModules(f.PythonPath)
+	if name, dir := python_path_modules.claim(f.config_ctx, modules); name != "" {
+		return "", fmt.Errorf("python_path: module %s is already imported from %s by another python block, sys.path is shared by all apps", name, dir)
+	}
+	python_path := f.PythonPath
+	if f.Archive != "" {
+		archive_path, err := archivePythonPath(f.Archive)
+		if err != nil {
+			return "", err
+		}
+		f.logger.Info("importing app from archive", zap.String("archive", f.Archive), zap.Strings("python_path", archive_path))
+		python_path = append(archive_path, python_path...)
+	}
+	if f.Project != "" {
+		python_path = append([]string{f.Project}, python_path...)
+	}
+	if err := addPythonPath(python_path); err != nil {
+		return "", err
+	}
+	venv_path := f.VenvPath
+	if venv_path == "off" {
+		venv_path = ""
+	} else if venv_path == "" {
+		venv_path = findVenv(f.project_dir)
+		if venv_path != "" {
+			f.logger.Info("using virtual environment found in project directory", zap.String("venv_path", venv_path))
+		}
+	}
+	if f.AutoInstall == "on" {
+		if f.VenvPath == "off" {
+			return "", errors.New("auto_install needs a venv, it can't be used with venv off")
+		}
+		if venv_path == "" {
+			venv_path = filepath.Join(f.project_dir, ".venv")
+		}
+		if err := installDependencies(f.logger, f.project_dir, venv_path); err != nil {
+			return "", err
+		}
+	}
+	return venv_path, nil
+}
+
+// importApp imports an ASGI or WSGI app and sets up what it needs to run requests.
+func (f *CaddySnake) importApp(pattern string, is_asgi bool, venv_path string) (AppServer, error) {
+	if !is_asgi {
+		app, err := NewWsgi(pattern, venv_path)
+		if err != nil {
+			return nil, err
+		}
+		if f.AutoInstall == "on" {
+			app.app_stats.install_dir.Store(f.project_dir)
+		}
+		threads := f.WsgiThreads
+		if threads == 0 {
+			threads = defaultWsgiThreads
+		}
+		startWsgiThreads(threads)
+		return app, nil
+	}
+	event_loop := f.EventLoop
+	if event_loop == "" {
+		event_loop = "auto"
+	}
+	app, err := NewAsgi(pattern, venv_path, f.Lifespan == "on", event_loop)
+	if err != nil {
+		return nil, err
+	}
+	asgi_lock.RLock()
+	running := asgi_event_loop
+	asgi_lock.RUnlock()
+	if event_loop != "auto" && event_loop != running {
+		f.logger.Warn("event_loop is ignored, all ASGI apps share the loop that's already running", zap.String("event_loop", event_loop), zap.String("running", running))
+	}
+	if f.AutoInstall == "on" {
+		app.app_stats.install_dir.Store(f.project_dir)
+	}
+	if f.AsgiExecutorThreads > 0 {
+		setAsgiExecutorThreads(f.AsgiExecutorThreads)
+	}
+	return app, nil
+}
+
+// Validate implements caddy.Validator.
+func (m *CaddySnake) Validate() error {
+	if m.RequestBodyChunkSize < 0 {
+		return fmt.Errorf("invalid request_body_chunk_size: %d", m.RequestBodyChunkSize)
+	}
+	if m.MaxRequestBody < 0 {
+		return fmt.Errorf("invalid max_request_body: %d", m.MaxRequestBody)
+	}
+	if m.SpoolThreshold < 0 {
+		return fmt.Errorf("invalid request_body_spool_threshold: %d", m.SpoolThreshold)
+	}
+	if m.AutoInstall != "" && m.AutoInstall != "on" && m.AutoInstall != "off" {
+		return fmt.Errorf("invalid auto_install: %s", m.AutoInstall)
+	}
+	if m.WatchDependencies != "" && m.WatchDependencies != "on" && m.WatchDependencies != "off" {
+		return fmt.Errorf("invalid watch_dependencies: %s", m.WatchDependencies)
+	}
+	if m.DjangoMigrate != "" && m.DjangoMigrate != "on" && m.DjangoMigrate != "off" {
+		return fmt.Errorf("invalid django_migrate: %s", m.DjangoMigrate)
+	}
+	if m.DjangoCollectstatic != "" && m.DjangoCollectstatic != "on" && m.DjangoCollectstatic != "off" {
+		return fmt.Errorf("invalid django_collectstatic: %s", m.DjangoCollectstatic)
+	}
+	for _, command := range m.OnStartup {
+		if len(command) == 0 || command[0] == "" {
+			return errors.New("on_startup needs a command")
+		}
+	}
+	if m.EventLoop != "" && m.EventLoop != "auto" && m.EventLoop != "asyncio" && m.EventLoop != "uvloop" {
+		return fmt.Errorf("invalid event_loop: %s", m.EventLoop)
+	}
+	for key := range m.Env {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			return fmt.Errorf("invalid env variable name: %q", key)
+		}
+	}
+	if m.WsgiThreads < 0 {
+		return fmt.Errorf("invalid wsgi_threads: %d", m.WsgiThreads)
+	}
+	if m.AsgiExecutorThreads < 0 {
+		return fmt.Errorf("invalid asgi_executor_threads: %d", m.AsgiExecutorThreads)
+	}
+	if m.Timeout < 0 {
+		return fmt.Errorf("invalid timeout: %s", time.Duration(m.Timeout))
+	}
+	if m.HealthPath != "" && !strings.HasPrefix(m.HealthPath, "/") {
+		return fmt.Errorf("invalid health_path: %q", m.HealthPath)
+	}
+	if m.HealthCheck != "" {
+		if m.HealthPath == "" {
+			return errors.New("health_check needs a health_path")
+		}
+		module, name, ok := strings.Cut(m.HealthCheck, ":")
+		if !ok || module == "" || name == "" {
+			return fmt.Errorf("invalid health_check, expected module:callable: %s", m.HealthCheck)
+		}
+	}
+	hosts := map[string]bool{}
+	for _, host := range m.Hosts {
+		name := strings.ToLower(host.Host)
+		if name == "" || strings.ContainsAny(name, "/:") || strings.Contains(name[1:], "*") ||
+			(strings.HasPrefix(name, "*") && !strings.HasPrefix(name, "*.")) {
+			return fmt.Errorf("invalid host: %q", host.Host)
+		}
+		if hosts[name] {
+			return fmt.Errorf("duplicate host: %s", host.Host)
+		}
+		hosts[name] = true
+	}
+	prefixes := map[string]bool{}
+	for _, mount := range m.Mounts {
+		prefix := strings.TrimSuffix(mount.PathPrefix, "/")
+		if !strings.HasPrefix(mount.PathPrefix, "/") || prefix == "" {
+			return fmt.Errorf("invalid mount path prefix: %q", mount.PathPrefix)
+		}
+		if prefixes[prefix] {
+			return fmt.Errorf("duplicate mount path prefix: %s", mount.PathPrefix)
+		}
+		prefixes[prefix] = true
+	}
+	return nil
+}
+
+// Cleanup frees resources uses by module
+func (m *CaddySnake) Cleanup() error {
+	stacks_signal.stop()
+	reload_signal.stop()
+	if m.stop_watching != nil {
+		m.stop_watching()
+	}
+	python_env.release(m.config_ctx)
+	python_path_modules.release(m.config_ctx)
+	// Every app is cleaned up even if another one fails
+	var errs []error
+	for _, mount := range m.mounts {
+		if err := mount.app.Cleanup(); err != nil {
+			errs = append(errs, fmt.Errorf("mount %s: %w", mount.prefix, err))
+		}
+	}
+	for host, app := range m.hosts {
+		if err := app.app.Cleanup(); err != nil {
+			errs = append(errs, fmt.Errorf("host %s: %w", host, err))
+		}
+	}
+	if m.app != nil {
+		m.logger.Info("cleaning up module")
+		if err := m.app.Cleanup(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// defaultRequestBodyChunkSize is the size of the request body chunks sent to ASGI apps
+const defaultRequestBodyChunkSize = 64 * 1024
+
+// requestOptionsCtxKey is the context key for the handler settings of a request
+const requestOptionsCtxKey caddy.CtxKey = "python_request_options"
+
+// requestOptions holds the handler settings that apply to a single request. Apps are
+// shared between handlers with the same module, so these travel in the request context.
+type requestOptions struct {
+	rootPath       string
+	bodyChunkSize  int
+	timeout        time.Duration
+	spoolThreshold int64
+	logger         *zap.Logger
+	trustedProxies []netip.Prefix
+}
+
+// rootPath returns the path prefix where the app is mounted. It's either set explicitly
+// with root_path or detected from a prefix stripped by handle_path/uri strip_prefix.
+func (f CaddySnake) rootPath(r *http.Request) string {
+	if f.RootPath != "" {
+		return strings.TrimSuffix(f.RootPath, "/")
+	}
+	orig, ok := r.Context().Value(caddyhttp.OriginalRequestCtxKey).(http.Request)
+	if !ok || orig.URL == nil {
+		return ""
+	}
+	if len(orig.URL.Path) > len(r.URL.Path) && strings.HasSuffix(orig.URL.Path, r.URL.Path) {
+		return strings.TrimSuffix(orig.URL.Path[:len(orig.URL.Path)-len(r.URL.Path)], "/")
+	}
+	return ""
+}
+
+// timeoutChan returns a channel that fires when the request timeout expires, or
+// nil when there's no timeout. The returned function releases the timer.
+func (opts requestOptions) timeoutChan() (<-chan time.Time, func() bool) {
+	if opts.timeout <= 0 {
+		return nil, func() bool { return false }
+	}
+	timer := time.NewTimer(opts.timeout)
+	return timer.C, timer.Stop
+}
+
+// errTimeout is returned to Caddy when the Python app doesn't respond in time
+var errTimeout = caddyhttp.Error(http.StatusGatewayTimeout, errors.New("python app timed out"))
+
+// pythonLogger returns the logger for Python output and messages that aren't tied to a
+// handler or request
+func pythonLogger() *zap.Logger {
+	return caddy.Log().Named("http.handlers.python")
+}
+
+// getRequestOptions returns the options stored in the request context by ServeHTTP
+func getRequestOptions(r *http.Request) requestOptions {
+	opts, _ := r.Context().Value(requestOptionsCtxKey).(requestOptions)
+	if opts.bodyChunkSize <= 0 {
+		opts.bodyChunkSize = defaultRequestBodyChunkSize
+	}
+	if opts.logger == nil {
+		opts.logger = pythonLogger()
+	}
+	return opts
+}
+
+// isBodyTooLarge reports whether err was caused by a body bigger than max_request_body
+func isBodyTooLarge(err error) bool {
+	var max_err *http.MaxBytesError
+	return errors.As(err, &max_err)
+}
+
+// requestBodyError turns errors caused by a body bigger than max_request_body into
+// a 413 response.
+func requestBodyError(err error) error {
+	if isBodyTooLarge(err) {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge, err)
+	}
+	return err
+}
+
+// healthTimeout is how long the health endpoints wait for Python to respond
+const healthTimeout = 5 * time.Second
+
+// healthProbe is a call into Python to check that it's healthy
+type healthProbe struct {
+	done    chan struct{}
+	healthy bool
+}
+
+var (
+	health_lock   sync.Mutex
+	health_probes = map[string]*healthProbe{}
+)
+
+// checkHealth calls the health check named by target in Python, or only checks that the
+// interpreter responds when target is empty. Concurrent checks for the same target share
+// a probe, so they don't pile up while the interpreter is stuck.
+func checkHealth(target string) *healthProbe {
+	health_lock.Lock()
+	defer health_lock.Unlock()
+	if probe, ok := health_probes[target]; ok {
+		return probe
+	}
+	probe := &healthProbe{done: make(chan struct{})}
+	health_probes[target] = probe
+	go func() {
+		target_str := C.CString(target)
+		defer C.free(unsafe.Pointer(target_str))
+		runtime.LockOSThread()
+		probe.healthy = C.Py_health_check(target_str) == 1
+		runtime.UnlockOSThread()
+		health_lock.Lock()
+		delete(health_probes, target)
+		health_lock.Unlock()
+		close(probe.done)
+	}()
+	return probe
+}
+
+// serveHealth responds to a liveness or readiness probe
+func serveHealth(w http.ResponseWriter, r *http.Request, target string) error {
+	probe := checkHealth(target)
+	timer := time.NewTimer(healthTimeout)
+	defer timer.Stop()
+	status, message := http.StatusOK, "ok\n"
+	select {
+	case <-probe.done:
+		if !probe.healthy {
+			status, message = http.StatusServiceUnavailable, "unhealthy\n"
+		}
+	case <-timer.C:
+		status, message = http.StatusServiceUnavailable, "python timed out\n"
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_, err := io.WriteString(w, message)
+	return err
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (f CaddySnake) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if probe, ok := strings.CutPrefix(r.URL.Path, strings.TrimSuffix(f.HealthPath, "/")); ok && f.HealthPath != "" {
+		switch probe {
+		case "/live":
+			return serveHealth(w, r, "")
+		case "/ready":
+			return serveHealth(w, r, f.HealthCheck)
+		}
+	}
+	if f.MaxRequestBody > 0 {
+		if r.ContentLength > f.MaxRequestBody {
+			return caddyhttp.Error(http.StatusRequestEntityTooLarge, &http.MaxBytesError{Limit: f.MaxRequestBody})
+		}
+		// Bodies without a known length are cut when the app reads past the limit
+		r.Body = http.MaxBytesReader(w, r.Body, f.MaxRequestBody)
+	}
+	app, module, root_path := f.app, f.ModuleWsgi+f.ModuleAsgi, f.rootPath(r)
+	if host, ok := f.findHost(r.Host); ok {
+		app, module = host.app, host.module
+	} else if mount, ok := f.findMount(r.URL.Path); ok {
+		app, module, root_path = mount.app, mount.module, root_path+mount.prefix
+		r = stripPathPrefix(r, mount.prefix)
+	}
+	if app == nil {
+		return next.ServeHTTP(w, r)
+	}
+	repl, _ := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if repl != nil {
+		repl.Set("http.handlers.python.app", module)
+	}
+	opts := requestOptions{
+		rootPath:       root_path,
+		bodyChunkSize:  f.RequestBodyChunkSize,
+		timeout:        time.Duration(f.Timeout),
+		spoolThreshold: f.SpoolThreshold,
+		logger:         f.logger,
+		trustedProxies: f.trusted_proxies,
+	}
+	r, span := startSpan(r)
+	defer span.End()
+	r = r.WithContext(context.WithValue(r.Context(), requestOptionsCtxKey, opts))
+	stats := app.stats()
+	stats.requests.Add(1)
+	stats.in_flight.Add(1)
+	start := time.Now()
+	err := app.HandleRequest(w, r)
+	stats.in_flight.Add(-1)
+	if repl != nil {
+		duration := time.Since(start)
+		repl.Set("http.handlers.python.duration", duration)
+		repl.Set("http.handlers.python.duration_ms", duration.Seconds()*1e3)
+	}
+	if err != nil {
+		stats.errors.Add(1)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// tracePropagator reads and writes the W3C trace context and baggage headers
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// startSpan starts a span around the call to the Python app. Its parent is the span started by
+// Caddy's tracing handler, when it's enabled, or the trace context of the incoming request.
+// The span is written to the request headers, so instrumentation inside the app continues
+// the trace from it.
+func startSpan(r *http.Request) (*http.Request, trace.Span) {
+	ctx := r.Context()
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = tracePropagator.Extract(ctx, propagation.HeaderCarrier(r.Header))
+	}
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer("github.com/mliezun/caddy-snake")
+	ctx, span := tracer.Start(ctx, "python", trace.WithSpanKind(trace.SpanKindInternal))
+	r = r.WithContext(ctx)
+	if span.SpanContext().IsValid() {
+		r.Header = r.Header.Clone()
+		tracePropagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
+	}
+	return r, span
+}
+
+// findHost returns the app mapped to host. Exact names take precedence over wildcards.
+func (f CaddySnake) findHost(host string) (mountedApp, bool) {
+	if len(f.hosts) == 0 {
+		return mountedApp{}, false
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if app, ok := f.hosts[host]; ok {
+		return app, true
+	}
+	if _, parent, ok := strings.Cut(host, "."); ok {
+		app, ok := f.hosts["*."+parent]
+		return app, ok
+	}
+	return mountedApp{}, false
+}
+
+// findMount returns the mounted app whose prefix matches path
+func (f CaddySnake) findMount(path string) (mountedApp, bool) {
+	for _, mount := range f.mounts {
+		if path == mount.prefix || strings.HasPrefix(path, mount.prefix+"/") {
+			return mount, true
+		}
+	}
+	return mountedApp{}, false
+}
+
+// stripPathPrefix returns a shallow copy of r without prefix in its path, like http.StripPrefix.
+func stripPathPrefix(r *http.Request, prefix string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+	if r2.URL.Path == "" {
+		r2.URL.Path = "/"
+	}
+	if raw_path, ok := strings.CutPrefix(r.URL.RawPath, prefix); ok && raw_path != "" {
+		r2.URL.RawPath = raw_path
+	} else {
+		// Path is used as is when the prefix is escaped differently
+		r2.URL.RawPath = ""
+	}
+	return r2
+}
+
+// AdminAPI is a Caddy admin module that reports the loaded Python apps
+type AdminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.python",
+		New: func() caddy.Module { return new(AdminAPI) },
+	}
+}
+
+// Routes returns the admin routes of the module.
+func (a AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/python/apps", Handler: caddy.AdminHandlerFunc(a.handleApps)},
+		{Pattern: "/python/apps/", Handler: caddy.AdminHandlerFunc(a.handleReload)},
+		{Pattern: "/python/stacks", Handler: caddy.AdminHandlerFunc(a.handleStacks)},
+		{Pattern: "/python/runtime", Handler: caddy.AdminHandlerFunc(a.handleRuntime)},
+		{Pattern: "/python/memory", Handler: caddy.AdminHandlerFunc(a.handleMemory)},
+		{Pattern: "/python/memory/", Handler: caddy.AdminHandlerFunc(a.handleMemory)},
+	}
+}
+
+// adminAppStatus is an app in the response of /python/apps
+type adminAppStatus struct {
+	Module    string    `json:"module"`
+	Interface string    `json:"interface"`
+	VenvPath  string    `json:"venv_path"`
+	LoadedAt  time.Time `json:"loaded_at"`
+	Reloads   int64     `json:"reloads"`
+	Requests  int64     `json:"requests"`
+	InFlight  int64     `json:"in_flight"`
+	Errors    int64     `json:"errors"`
+}
+
+func newAdminAppStatus(stats *appStats, iface string) adminAppStatus {
+	return adminAppStatus{
+		Module:    stats.module,
+		Interface: iface,
+		VenvPath:  stats.venv_path,
+		LoadedAt:  time.Unix(0, stats.loaded_at.Load()).UTC(),
+		Reloads:   stats.reloads.Load(),
+		Requests:  stats.requests.Load(),
+		InFlight:  stats.in_flight.Load(),
+		Errors:    stats.errors.Load(),
+	}
+}
+
+// handleApps lists the apps that are loaded, shared by every python handler
+func (AdminAPI) handleApps(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	apps := []adminAppStatus{}
+	wsgi_lock.RLock()
+	for _, app := range wsgiapp_cache {
+		apps = append(apps, newAdminAppStatus(app.app_stats, "wsgi"))
+	}
+	wsgi_lock.RUnlock()
+	asgi_lock.RLock()
+	for _, app := range asgiapp_cache {
+		apps = append(apps, newAdminAppStatus(app.app_stats, "asgi"))
+	}
+	asgi_lock.RUnlock()
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].Module < apps[j].Module
+	})
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(apps)
+}
+
+// handleReload imports an app again, for POST /python/apps/{module:app}/reload
+func (AdminAPI) handleReload(w http.ResponseWriter, r *http.Request) error {
+	name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/python/apps/"), "/reload")
+	if !ok || name == "" {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("not found")}
+	}
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	status, err := reloadApp(name)
+	if errors.Is(err, errAppNotLoaded) {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: err}
+	} else if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(status)
+}
+
+// errAppNotLoaded is returned when reloading an app that isn't in the cache
+var errAppNotLoaded = errors.New("app not loaded")
+
+// reloadApp imports an app again. When the app uses auto_install, its dependencies are
+// installed first.
+func reloadApp(name string) (adminAppStatus, error) {
+	wsgi_lock.RLock()
+	wsgi_app := wsgiapp_cache[name]
+	wsgi_lock.RUnlock()
+	asgi_lock.RLock()
+	asgi_app := asgiapp_cache[name]
+	asgi_lock.RUnlock()
+
+	var stats *appStats
+	iface := "wsgi"
+	switch {
+	case wsgi_app != nil:
+		stats = wsgi_app.app_stats
+	case asgi_app != nil:
+		stats, iface = asgi_app.app_stats, "asgi"
+	default:
+		return adminAppStatus{}, fmt.Errorf("%w: %s", errAppNotLoaded, name)
+	}
+	// Dependency files may have changed with the code, e.g. after a deploy
+	if install_dir, _ := stats.install_dir.Load().(string); install_dir != "" {
+		if err := installDependencies(pythonLogger(), install_dir, stats.venv_path); err != nil {
+			return adminAppStatus{}, err
+		}
+	}
+	var err error
+	if wsgi_app != nil {
+		err = wsgi_app.Reload()
+	} else {
+		err = asgi_app.Reload()
+	}
+	if err != nil {
+		return adminAppStatus{}, err
+	}
+	pythonLogger().Info("reloaded app", zap.String("module", name))
+	return newAdminAppStatus(stats, iface), nil
+}
+
+// reload_signal reloads every app every time the process gets SIGHUP
+var reload_signal = &signalHandler{sig: syscall.SIGHUP, handle: reloadAllApps}
+
+func reloadAllApps() {
+	names := []string{}
+	wsgi_lock.RLock()
+	for name := range wsgiapp_cache {
+		names = append(names, name)
+	}
+	wsgi_lock.RUnlock()
+	asgi_lock.RLock()
+	for name := range asgiapp_cache {
+		names = append(names, name)
+	}
+	asgi_lock.RUnlock()
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := reloadApp(name); err != nil {
+			pythonLogger().Error("reloading app", zap.String("module", name), zap.Error(err))
+		}
+	}
+}
+
+// handleStacks returns the stacks of all Python threads and ASGI tasks, for GET /python/stacks
+func (AdminAPI) handleStacks(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	stacks, err := dumpPythonStacks()
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err = io.WriteString(w, stacks)
+	return err
+}
+
+// dumpPythonStacks returns the stacks of all Python threads and ASGI tasks
+func dumpPythonStacks() (string, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	stacks := C.Py_dump_stacks()
+	if stacks == nil {
+		return "", errors.New("failed to dump python stacks")
+	}
+	defer C.free(unsafe.Pointer(stacks))
+	return C.GoString(stacks), nil
+}
+
+// handleMemory reports allocations traced with tracemalloc. Tracing is off until
+// POST /python/memory/start, and POST /python/memory/stop turns it off again.
+// GET /python/memory?limit=N returns the top N allocation sites, overall and per app.
+func (AdminAPI) handleMemory(w http.ResponseWriter, r *http.Request) error {
+	command := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/python/memory"), "/")
+	method := http.MethodPost
+	switch command {
+	case "":
+		command, method = "stats", http.MethodGet
+	case "start", "stop":
+	default:
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("not found")}
+	}
+	if r.Method != method {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	limit := 10
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid limit: %s", value),
+			}
+		}
+	}
+
+	modules := []string{}
+	wsgi_lock.RLock()
+	for _, app := range wsgiapp_cache {
+		modules = append(modules, app.app_stats.module)
+	}
+	wsgi_lock.RUnlock()
+	asgi_lock.RLock()
+	for _, app := range asgiapp_cache {
+		modules = append(modules, app.app_stats.module)
+	}
+	asgi_lock.RUnlock()
+	sort.Strings(modules)
+
+	command_str := C.CString(command)
+	defer C.free(unsafe.Pointer(command_str))
+	modules_str := C.CString(strings.Join(modules, "\n"))
+	defer C.free(unsafe.Pointer(modules_str))
+	runtime.LockOSThread()
+	profile := C.Py_memory_profile(command_str, modules_str, C.int(limit))
+	runtime.UnlockOSThread()
+	if profile == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("failed to profile memory"),
+		}
+	}
+	defer C.free(unsafe.Pointer(profile))
+	w.Header().Set("Content-Type", "application/json")
+	_, err := io.WriteString(w, C.GoString(profile))
+	return err
+}
+
+// callTimes accumulates the time calls from Go into Python spent waiting for the GIL
+// and holding it
+type callTimes struct {
+	count   atomic.Int64
+	gil_ns  atomic.Int64
+	call_ns atomic.Int64
+}
+
+// call_times has the totals of the calls that start a request, by interface
+var call_times = map[string]*callTimes{"wsgi": {}, "asgi": {}}
+
+var (
+	gilWaitSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "caddy",
+		Subsystem: "python",
+		Name:      "gil_wait_seconds",
+		Help:      "Time calls from Go waited for the GIL before starting a request.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+	}, []string{"interface"})
+	callSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "caddy",
+		Subsystem: "python",
+		Name:      "call_seconds",
+		Help:      "Time calls from Go held the GIL to start a request.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+	}, []string{"interface"})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "python",
+		Name:      "wsgi_queue_depth",
+		Help:      "WSGI requests waiting for a thread of the pool.",
+	}, func() float64 { return float64(C.Wsgi_queue_depth()) })
+)
+
+//export python_call_timing
+func python_call_timing(call *C.char, gil_wait_ns C.int64_t, call_ns C.int64_t) {
+	iface := C.GoString(call)
+	times, ok := call_times[iface]
+	if !ok {
+		return
+	}
+	times.count.Add(1)
+	times.gil_ns.Add(int64(gil_wait_ns))
+	times.call_ns.Add(int64(call_ns))
+	gilWaitSeconds.WithLabelValues(iface).Observe(float64(gil_wait_ns) / 1e9)
+	callSeconds.WithLabelValues(iface).Observe(float64(call_ns) / 1e9)
+}
+
+// adminCallTimes are the totals of calls into Python in the response of /python/runtime
+type adminCallTimes struct {
+	Count          int64   `json:"count"`
+	GilWaitSeconds float64 `json:"gil_wait_seconds"`
+	CallSeconds    float64 `json:"call_seconds"`
+}
+
+// handleRuntime reports where time goes between Go and Python, for GET /python/runtime
+func (AdminAPI) handleRuntime(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	calls := map[string]adminCallTimes{}
+	for iface, times := range call_times {
+		calls[iface] = adminCallTimes{
+			Count:          times.count.Load(),
+			GilWaitSeconds: float64(times.gil_ns.Load()) / 1e9,
+			CallSeconds:    float64(times.call_ns.Load()) / 1e9,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]any{
+		"wsgi_queue_depth": int64(C.Wsgi_queue_depth()),
+		"calls":            calls,
+	})
+}
+
+// signalHandler runs handle every time the process gets sig. It's only listening while a
+// python handler is provisioned, so other caddy commands keep the default behavior.
+type signalHandler struct {
+	sig     os.Signal
+	handle  func()
+	lock    sync.Mutex
+	users   int
+	signals chan os.Signal
+}
+
+// start starts listening for the signal when the first python handler is provisioned
+func (s *signalHandler) start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.users++
+	if s.users > 1 {
+		return
+	}
+	s.signals = make(chan os.Signal, 1)
+	signal.Notify(s.signals, s.sig)
+	go func(signals chan os.Signal) {
+		for range signals {
+			s.handle()
+		}
+	}(s.signals)
+}
+
+// stop stops listening for the signal when the last python handler is cleaned up
+func (s *signalHandler) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.users == 0 {
+		return
+	}
+	s.users--
+	if s.users > 0 {
+		return
+	}
+	signal.Stop(s.signals)
+	close(s.signals)
+}
+
+// stacks_signal logs the Python stacks every time the process gets SIGUSR2
+var stacks_signal = &signalHandler{sig: syscall.SIGUSR2, handle: logPythonStacks}
+
+func logPythonStacks() {
+	stacks, err := dumpPythonStacks()
+	if err != nil {
+		pythonLogger().Error("dumping stacks", zap.Error(err))
+		return
+	}
+	pythonLogger().Info("python stacks", zap.String("stacks", stacks))
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*CaddySnake)(nil)
+	_ caddy.Validator             = (*CaddySnake)(nil)
+	_ caddy.CleanerUpper          = (*CaddySnake)(nil)
+	_ caddyhttp.MiddlewareHandler = (*CaddySnake)(nil)
+	_ caddyfile.Unmarshaler       = (*CaddySnake)(nil)
+	_ caddy.AdminRouter           = (*AdminAPI)(nil)
+)
+
+func parsePythonDirective(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var app CaddySnake
+	if err := app.UnmarshalCaddyfile(h.Dispenser); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// WsgiRequestHandler tracks the state of a HTTP request to a WSGI App
+type WsgiRequestHandler struct {
+	logger    *zap.Logger
+	body      io.Reader
+	body_err  error
+	responses chan WsgiResponse
+	written   chan bool
+	done      chan struct{}
+
+	// body_lock is held while the app reads the body, which can't be read once the
+	// handler returns
+	body_lock   sync.Mutex
+	body_closed bool
+}
+
+// closeBody waits for a read of the body in progress and fails the next ones
+func (h *WsgiRequestHandler) closeBody() {
+	h.body_lock.Lock()
+	h.body_closed = true
+	h.body_lock.Unlock()
+}
+
+// WsgiResponse is a chunk of the response produced by a WSGI App. The status code
+// and headers are only used from the first chunk.
+type WsgiResponse struct {
+	status_code C.int
+	headers     *C.MapKeyVal
+	body        []byte
+	more_body   bool
+	file        *os.File
+}
+
+var wsgi_lock sync.RWMutex = sync.RWMutex{}
+var wsgi_state *WsgiGlobalState = NewWsgiGlobalState()
+
+// wsgiStateShards is the number of shards used to keep in-flight WSGI requests
+const wsgiStateShards = 64
+
+// WsgiGlobalState keeps the handlers of in-flight WSGI requests. Handlers are split in
+// shards by request id, so concurrent requests don't contend on a single lock.
+type WsgiGlobalState struct {
+	request_counter atomic.Int64
+	shards          [wsgiStateShards]wsgiStateShard
+}
+
+type wsgiStateShard struct {
+	sync.RWMutex
+	handlers map[int64]*WsgiRequestHandler
+}
+
+// NewWsgiGlobalState initializes the shards
+func NewWsgiGlobalState() *WsgiGlobalState {
+	s := &WsgiGlobalState{}
+	for i := range s.shards {
+		s.shards[i].handlers = map[int64]*WsgiRequestHandler{}
+	}
+	return s
+}
+
+func (s *WsgiGlobalState) shard(request_id int64) *wsgiStateShard {
+	return &s.shards[uint64(request_id)%wsgiStateShards]
+}
+
+// Request stores a handler and returns the id of the new request
+func (s *WsgiGlobalState) Request(h *WsgiRequestHandler) int64 {
+	request_id := s.request_counter.Add(1)
+	shard := s.shard(request_id)
+	shard.Lock()
+	shard.handlers[request_id] = h
+	shard.Unlock()
+	return request_id
+}
+
+// Get returns the handler of a request that's still in-flight
+func (s *WsgiGlobalState) Get(request_id int64) (*WsgiRequestHandler, bool) {
+	shard := s.shard(request_id)
+	shard.RLock()
+	h, ok := shard.handlers[request_id]
+	shard.RUnlock()
+	return h, ok
+}
+
+// Cleanup removes a finished request
+func (s *WsgiGlobalState) Cleanup(request_id int64) {
+	shard := s.shard(request_id)
+	shard.Lock()
+	delete(shard.handlers, request_id)
+	shard.Unlock()
+}
+
+func init() {
+	setup_py := C.CString(caddysnake_py)
+	defer C.free(unsafe.Pointer(setup_py))
+	C.Py_init_and_release_gil(setup_py)
+	caddy.RegisterModule(CaddySnake{})
+	caddy.RegisterModule(AdminAPI{})
+	httpcaddyfile.RegisterHandlerDirective("python", parsePythonDirective)
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "python-check",
+		Usage: "--module <module:app> [--interface auto|wsgi|asgi] [--venv <path>] [--project <dir>] [--python-path <dirs>] [--lifespan]",
+		Short: "Checks that a Python app can be imported",
+		Long: `
+Imports a Python app the same way the python handler does, as a preflight for
+CI and deploys. The venv is found in the project directory unless --venv is set,
+and whether the app is ASGI or WSGI is detected unless --interface is set.
+
+With --lifespan, the startup and shutdown of an ASGI app are run too.
+
+The Python traceback is logged when the app fails to import.`,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("python-check", flag.ExitOnError)
+			fs.String("module", "", "The app to import, as module:app")
+			fs.String("interface", "auto", "The interface of the app: auto, wsgi or asgi")
+			fs.String("venv", "", "The virtual environment of the app")
+			fs.String("project", "", "The project directory, with a pyproject.toml")
+			fs.String("python-path", "", "Directories to add to sys.path, separated like PATH")
+			fs.Bool("lifespan", false, "Run the lifespan startup and shutdown of an ASGI app")
+			return fs
+		}(),
+		Func: cmdPythonCheck,
+	})
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "python-shell",
+		Usage: "[--module <module:app>] [--venv <path>] [--project <dir>] [--python-path <dirs>] [-c <command>]",
+		Short: "Opens a Python shell set up like the python handler",
+		Long: `
+Opens an interactive Python console with the same venv, sys.path and
+environment the python handler would import the app with. The venv is found in
+the project directory unless --venv is set, and the [tool.caddy-snake.env]
+table of the project's pyproject.toml is applied.
+
+With --module, the app is imported and available as "app". With -c, the command
+is run instead of opening a console, and the exit code is the command's.`,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("python-shell", flag.ExitOnError)
+			fs.String("module", "", "The app to import as app, as module:app")
+			fs.String("venv", "", "The virtual environment of the app")
+			fs.String("project", "", "The project directory, with a pyproject.toml")
+			fs.String("python-path", "", "Directories to add to sys.path, separated like PATH")
+			fs.String("c", "", "The Python command to run instead of opening a console")
+			return fs
+		}(),
+		Func: cmdPythonShell,
+	})
+}
+
+// cmdPythonCheck imports an app with the same settings as the python handler and reports
+// whether it can be served
+func cmdPythonCheck(fl caddycmd.Flags) (int, error) {
+	module := fl.String("module")
+	if module == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--module is required")
+	}
+	f := &CaddySnake{
+		VenvPath: fl.String("venv"),
+		Project:  fl.String("project"),
+	}
+	switch fl.String("interface") {
+	case "auto":
+		f.Module = module
+	case "wsgi":
+		f.ModuleWsgi = module
+	case "asgi":
+		f.ModuleAsgi = module
+	default:
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("invalid interface: %s", fl.String("interface"))
+	}
+	if python_path := fl.String("python-path"); python_path != "" {
+		f.PythonPath = filepath.SplitList(python_path)
+	}
+	if fl.Bool("lifespan") {
+		f.Lifespan = "on"
+	}
+	if err := f.Validate(); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if err := f.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("importing %s: %w", module, err)
+	}
+	iface := "wsgi"
+	if f.ModuleAsgi != "" {
+		iface = "asgi"
+	}
+	venv_path := f.app.stats().venv_path
+	if venv_path == "" {
+		venv_path = "none"
+	}
+	fmt.Printf("%s app %s imported, venv: %s\n", iface, module, venv_path)
+	if err := f.Cleanup(); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("shutting down %s: %w", module, err)
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// cmdPythonShell runs a command or an interactive console in the interpreter set up like
+// the python handler would
+func cmdPythonShell(fl caddycmd.Flags) (int, error) {
+	f := &CaddySnake{
+		VenvPath: fl.String("venv"),
+		Project:  fl.String("project"),
+		logger:   caddy.Log(),
+	}
+	if python_path := fl.String("python-path"); python_path != "" {
+		f.PythonPath = filepath.SplitList(python_path)
+	}
+	venv_path, err := f.prepareInterpreter()
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	var packages_path *C.char = nil
+	if venv_path != "" {
+		sitePackagesPath, err := findSitePackagesInVenv(venv_path)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		packages_path = C.CString(sitePackagesPath)
+		defer C.free(unsafe.Pointer(packages_path))
+	}
+	var command *C.char = nil
+	if fl.Changed("c") {
+		command = C.CString(fl.String("c"))
+		defer C.free(unsafe.Pointer(command))
+	}
+	target := C.CString(fl.String("module"))
+	defer C.free(unsafe.Pointer(target))
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	return int(C.Py_shell(command, target, packages_path)), nil
+}
+
+// interpreterSettings records, for each loaded config, settings that apply to the whole
+// interpreter. Python blocks of a config can't set them to different values, since one
+// would silently override the other. Configs are told apart by their context, so a
+// reloaded config can change them.
+type interpreterSettings struct {
+	sync.Mutex
+	configs map[context.Context]map[string]string
+}
+
+// python_env holds the env of every python block
+var python_env = &interpreterSettings{configs: map[context.Context]map[string]string{}}
+
+// claim records values for the config of ctx. It returns the first name that another
+// python block of that config set to a different value, and that value.
+func (s *interpreterSettings) claim(ctx context.Context, values map[string]string) (string, string) {
+	s.Lock()
+	defer s.Unlock()
+	config, ok := s.configs[ctx]
+	if !ok {
+		config = map[string]string{}
+		s.configs[ctx] = config
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if value, ok := config[name]; ok && value != values[name] {
+			return name, value
+		}
+	}
+	for name, value := range values {
+		config[name] = value
+	}
+	return "", ""
+}
+
+// release forgets the settings of the config of ctx, once it's cleaned up
+func (s *interpreterSettings) release(ctx context.Context) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.configs, ctx)
+}
+
+// setPythonEnv sets environment variables in the Python interpreter. It's shared by all
+// apps, so they see the variables set by every python block.
+func setPythonEnv(env map[string]string) {
+	pairs := make([][2]string, 0, len(env))
+	for k, v := range env {
+		pairs = append(pairs, [2]string{k, v})
+	}
+	m := newMapKeyVal(pairs)
+	defer C.MapKeyVal_free(m)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	C.Py_set_environ(m)
+}
+
+// python_path_modules holds the top-level modules found in the python_path of every python
+// block, with the directory they're imported from
+var python_path_modules = &interpreterSettings{configs: map[context.Context]map[string]string{}}
+
+// pythonPathModules returns the top-level modules and packages in dirs, with the directory
+// each one is imported from. Like in sys.path, the first directory wins.
+func pythonPathModules(dirs []string) map[string]string {
+	modules := map[string]string{}
+	for _, dir := range dirs {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		// Missing directories are ignored, like Python does
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() {
+				if _, err := os.Stat(filepath.Join(dir, name, "__init__.py")); err != nil {
+					continue
+				}
+			} else if strings.HasSuffix(name, ".py") {
+				name = strings.TrimSuffix(name, ".py")
+			} else {
+				continue
+			}
+			if _, ok := modules[name]; !ok {
+				modules[name] = dir
+			}
+		}
+	}
+	return modules
+}
+
+// addPythonPath adds dirs to the start of sys.path, keeping their order. Relative paths are
+// resolved against the working directory.
+func addPythonPath(dirs []string) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir, err := filepath.Abs(dirs[i])
+		if err != nil {
+			return err
 		}
+		path := C.CString(dir)
+		C.Py_prepend_sys_path(path)
+		C.free(unsafe.Pointer(path))
 	}
 	return nil
 }
 
-// CaddyModule returns the Caddy module information.
-func (CaddySnake) CaddyModule() caddy.ModuleInfo {
-	return caddy.ModuleInfo{
-		ID:  "http.handlers.python",
-		New: func() caddy.Module { return new(CaddySnake) },
+// warnIfGilEnabled warns when running on a free-threaded Python that had to enable the GIL,
+// which happens when the app imports an extension module without free-threading support.
+func warnIfGilEnabled(logger *zap.Logger) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.Py_is_free_threaded() == 1 && C.Py_is_gil_enabled() == 1 {
+		logger.Warn("the GIL is enabled on a free-threaded Python, requests won't run in parallel")
 	}
 }
 
-// Provision sets up the module.
-func (f *CaddySnake) Provision(ctx caddy.Context) error {
-	f.logger = ctx.Logger(f)
-	if f.ModuleWsgi != "" {
-		w, err := NewWsgi(f.ModuleWsgi, f.VenvPath)
+// venvCandidates are the directories checked for a virtual environment when venv isn't set
+var venvCandidates = []string{".venv", "venv", ".conda", "env"}
+
+// findVenv looks for a virtual environment in project_dir. A directory counts as one when it
+// has a pyvenv.cfg file, which is created by venv, virtualenv and uv, or a conda-meta directory,
+// which is created by conda and micromamba. Returns an empty string when there's none.
+func findVenv(project_dir string) string {
+	for _, name := range venvCandidates {
+		dir := filepath.Join(project_dir, name)
+		if info, err := os.Stat(filepath.Join(dir, "pyvenv.cfg")); err == nil && !info.IsDir() {
+			return dir
+		}
+		if info, err := os.Stat(filepath.Join(dir, "conda-meta")); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	return ""
+}
+
+// archivePythonPath returns the sys.path entries needed to import an app from a zipapp, PEX or
+// shiv archive. Plain zipapps are imported straight from the archive with zipimport. Archives
+// that bundle dependencies, or extension modules that can't be loaded from a zip, are
+// extracted to the user cache directory, once per archive content.
+func archivePythonPath(archive string) ([]string, error) {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive %s: %w", archive, err)
+	}
+	defer reader.Close()
+
+	extract := false
+	for _, file := range reader.File {
+		name := file.Name
+		if strings.HasPrefix(name, ".deps/") || strings.HasPrefix(name, "site-packages/") ||
+			strings.HasSuffix(name, ".so") || strings.HasSuffix(name, ".pyd") {
+			extract = true
+			break
+		}
+	}
+	if !extract {
+		return []string{archive}, nil
+	}
+
+	content, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, content)
+	content.Close()
+	if err != nil {
+		return nil, err
+	}
+	cache_dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(cache_dir, "caddy-snake", hex.EncodeToString(hash.Sum(nil))[:16])
+	if _, err := os.Stat(dir); err != nil {
+		if err := extractArchive(reader, dir); err != nil {
+			return nil, fmt.Errorf("failed to extract archive %s: %w", archive, err)
+		}
+	}
+
+	// shiv keeps everything in site-packages, PEX keeps the app at the root
+	// and each dependency in its own directory under .deps
+	if info, err := os.Stat(filepath.Join(dir, "site-packages")); err == nil && info.IsDir() {
+		return []string{filepath.Join(dir, "site-packages")}, nil
+	}
+	paths := []string{dir}
+	deps, _ := os.ReadDir(filepath.Join(dir, ".deps"))
+	for _, dep := range deps {
+		if dep.IsDir() {
+			paths = append(paths, filepath.Join(dir, ".deps", dep.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// extractArchive extracts reader into dir. Files are written to a temporary directory that's
+// renamed at the end, so a partial extraction is never used.
+func extractArchive(reader *zip.ReadCloser, dir string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".extract-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	for _, file := range reader.File {
+		path := filepath.Join(tmp, file.Name)
+		if !strings.HasPrefix(path, tmp+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid file path: %s", file.Name)
+		}
+		if file.FileInfo().IsDir() {
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		src, err := file.Open()
 		if err != nil {
 			return err
 		}
-		if f.Lifespan != "" {
-			f.logger.Warn("lifespan is only used in ASGI mode", zap.String("lifespan", f.Lifespan))
+		dst, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, file.Mode().Perm()|0o600)
+		if err != nil {
+			src.Close()
+			return err
+		}
+		_, err = io.Copy(dst, src)
+		src.Close()
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
 		}
-		f.logger.Info("imported wsgi app", zap.String("module_wsgi", f.ModuleWsgi), zap.String("venv_path", f.VenvPath))
-		f.app = w
-	} else if f.ModuleAsgi != "" {
-		var err error
-		f.app, err = NewAsgi(f.ModuleAsgi, f.VenvPath, f.Lifespan == "on")
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	err = os.Rename(tmp, dir)
+	if err != nil && os.IsExist(err) {
+		// Extracted by another python block at the same time
+		return nil
+	}
+	return err
 }
 
-// Validate implements caddy.Validator.
-func (m *CaddySnake) Validate() error {
-	return nil
-}
+// loadProjectConfig fills the settings that aren't set in the Caddy config with the ones in
+// the [tool.caddy-snake] table of the project's pyproject.toml.
+func (f *CaddySnake) loadProjectConfig() error {
+	pyproject := filepath.Join(f.Project, "pyproject.toml")
+	if _, err := os.Stat(pyproject); err != nil {
+		return fmt.Errorf("invalid project: %w", err)
+	}
+	path := C.CString(pyproject)
+	defer C.free(unsafe.Pointer(path))
+	runtime.LockOSThread()
+	config := C.Py_read_project_config(path)
+	runtime.UnlockOSThread()
+	if config == nil {
+		return fmt.Errorf("failed to read [tool.caddy-snake] from %s", pyproject)
+	}
+	defer C.MapKeyVal_free(config)
 
-// Cleanup frees resources uses by module
-func (m *CaddySnake) Cleanup() error {
-	if m.app != nil {
-		m.logger.Info("cleaning up module")
-		return m.app.Cleanup()
+	keys, values := mapKeyValSlices(config)
+	settings := map[string]string{}
+	for i := range keys {
+		settings[C.GoString(keys[i])] = C.GoString(values[i])
+	}
+	if f.Module != "" || f.ModuleWsgi != "" || f.ModuleAsgi != "" {
+		// The app set in the Caddy config wins, along with its interface
+		delete(settings, "module")
+		delete(settings, "interface")
+	}
+	for key, value := range settings {
+		if name, ok := strings.CutPrefix(key, "env."); ok {
+			if name == "" || strings.ContainsAny(name, "=\x00") {
+				return fmt.Errorf("invalid env variable name in %s: %q", pyproject, name)
+			}
+			if _, ok := f.Env[name]; !ok {
+				if f.Env == nil {
+					f.Env = map[string]string{}
+				}
+				f.Env[name] = value
+			}
+			continue
+		}
+		switch key {
+		case "module":
+			switch settings["interface"] {
+			case "", "auto":
+				f.Module = value
+			case "wsgi":
+				f.ModuleWsgi = value
+			case "asgi":
+				f.ModuleAsgi = value
+			default:
+				return fmt.Errorf("invalid interface in %s: %s", pyproject, settings["interface"])
+			}
+		case "interface":
+			if settings["module"] == "" {
+				return fmt.Errorf("interface is set without a module in %s", pyproject)
+			}
+		case "lifespan":
+			if value != "on" && value != "off" {
+				return fmt.Errorf("invalid lifespan in %s: %s", pyproject, value)
+			}
+			if f.Lifespan == "" {
+				f.Lifespan = value
+			}
+		case "wsgi_threads":
+			threads, err := strconv.Atoi(value)
+			if err != nil || threads < 0 {
+				return fmt.Errorf("invalid wsgi_threads in %s: %s", pyproject, value)
+			}
+			if f.WsgiThreads == 0 {
+				f.WsgiThreads = threads
+			}
+		default:
+			return fmt.Errorf("unknown setting in %s: %s", pyproject, key)
+		}
 	}
 	return nil
 }
 
-// ServeHTTP implements caddyhttp.MiddlewareHandler.
-func (f CaddySnake) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	if err := f.app.HandleRequest(w, r); err != nil {
+// dependencyFiles are the files auto_install reads dependencies from, in order of preference
+var dependencyFiles = []string{"uv.lock", "requirements.txt", "pyproject.toml"}
+
+// installDependencies creates the venv and installs the dependencies declared in project_dir,
+// using uv when it's available and pip otherwise. A hash of the dependency files is stored in
+// the venv, so nothing is installed until they change.
+func installDependencies(logger *zap.Logger, project_dir string, venv_path string) error {
+	hash := sha256.New()
+	found := []string{}
+	for _, name := range dependencyFiles {
+		content, err := os.ReadFile(filepath.Join(project_dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		found = append(found, name)
+		fmt.Fprintf(hash, "%s\x00%d\x00", name, len(content))
+		hash.Write(content)
+	}
+	if len(found) == 0 {
+		return errors.New("auto_install didn't find requirements.txt, pyproject.toml or uv.lock")
+	}
+	_, uv_err := exec.LookPath("uv")
+	use_uv := uv_err == nil
+	if !use_uv && found[0] == "uv.lock" {
+		// Without uv the lock file can't be used, fall back to what's left
+		found = found[1:]
+		if len(found) == 0 {
+			return errors.New("auto_install needs uv to install from uv.lock")
+		}
+	}
+	runtime.LockOSThread()
+	python_version := fmt.Sprintf("3.%d", C.Py_minor_version())
+	runtime.UnlockOSThread()
+	fmt.Fprintf(hash, "python%s\x00uv=%t", python_version, use_uv)
+	digest := hex.EncodeToString(hash.Sum(nil))
+
+	venv_path, err := filepath.Abs(venv_path)
+	if err != nil {
 		return err
 	}
-	return next.ServeHTTP(w, r)
+	hash_path := filepath.Join(venv_path, ".caddysnake-dependencies")
+	if previous, err := os.ReadFile(hash_path); err == nil && string(previous) == digest {
+		logger.Info("dependencies are up to date", zap.String("venv_path", venv_path))
+		return nil
+	}
+
+	python := filepath.Join(venv_path, "bin", "python")
+	commands := [][]string{}
+	if _, err := os.Stat(filepath.Join(venv_path, "pyvenv.cfg")); err != nil {
+		if use_uv {
+			commands = append(commands, []string{"uv", "venv", "--python", python_version, venv_path})
+		} else {
+			commands = append(commands, []string{"python" + python_version, "-m", "venv", venv_path})
+		}
+	}
+	switch {
+	case found[0] == "uv.lock":
+		commands = append(commands, []string{"uv", "sync", "--frozen", "--python", python})
+	case found[0] == "requirements.txt" && use_uv:
+		commands = append(commands, []string{"uv", "pip", "install", "--python", python, "-r", "requirements.txt"})
+	case found[0] == "requirements.txt":
+		commands = append(commands, []string{python, "-m", "pip", "install", "-r", "requirements.txt"})
+	case use_uv:
+		commands = append(commands, []string{"uv", "pip", "install", "--python", python, "."})
+	default:
+		commands = append(commands, []string{python, "-m", "pip", "install", "."})
+	}
+
+	logger.Info("installing dependencies", zap.String("from", found[0]), zap.String("venv_path", venv_path))
+	for _, args := range commands {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = project_dir
+		// uv sync installs into UV_PROJECT_ENVIRONMENT instead of the project's .venv
+		cmd.Env = append(os.Environ(), "UV_PROJECT_ENVIRONMENT="+venv_path)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("auto_install failed running %s: %w\n%s", strings.Join(args, " "), err, output)
+		}
+		logger.Debug("ran install command", zap.Strings("command", args), zap.ByteString("output", output))
+	}
+	return os.WriteFile(hash_path, []byte(digest), 0o644)
 }
 
-// Interface guards
-var (
-	_ caddy.Provisioner           = (*CaddySnake)(nil)
-	_ caddy.Validator             = (*CaddySnake)(nil)
-	_ caddy.CleanerUpper          = (*CaddySnake)(nil)
-	_ caddyhttp.MiddlewareHandler = (*CaddySnake)(nil)
-	_ caddyfile.Unmarshaler       = (*CaddySnake)(nil)
-)
+// dependencyWatchInterval is how often watch_dependencies checks the dependency files
+const dependencyWatchInterval = 2 * time.Second
 
-func parsePythonDirective(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
-	var app CaddySnake
-	if err := app.UnmarshalCaddyfile(h.Dispenser); err != nil {
-		return nil, err
+// dependencyFilesVersion returns the size and modification time of the dependency files in
+// project_dir, it changes when any of them is written, created or removed
+func dependencyFilesVersion(project_dir string) string {
+	version := ""
+	for _, name := range dependencyFiles {
+		if info, err := os.Stat(filepath.Join(project_dir, name)); err == nil {
+			version += fmt.Sprintf("%s:%d:%d;", name, info.Size(), info.ModTime().UnixNano())
+		}
 	}
-	return app, nil
+	return version
 }
 
-// WsgiRequestHandler tracks the state of a HTTP request to a WSGI App
-type WsgiRequestHandler struct {
-	status_code C.int
-	headers     *C.MapKeyVal
-	body        *C.char
+// watchDependencies reloads modules when the dependency files in project_dir change, with
+// auto_install their dependencies are installed first, see reloadApp. The files are polled,
+// like caddy run --watch does with the config. Returns a function that stops watching.
+func watchDependencies(logger *zap.Logger, project_dir string, modules []string) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(dependencyWatchInterval)
+		defer ticker.Stop()
+		version := dependencyFilesVersion(project_dir)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			current := dependencyFilesVersion(project_dir)
+			if current == version {
+				continue
+			}
+			version = current
+			logger.Info("dependency files changed, reloading", zap.String("project_dir", project_dir), zap.Strings("modules", modules))
+			for _, module := range modules {
+				if _, err := reloadApp(module); err != nil {
+					logger.Error("reloading app", zap.String("module", module), zap.Error(err))
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
 }
 
-var wsgi_lock sync.RWMutex = sync.RWMutex{}
-var wsgi_request_counter int64 = 0
-var wsgi_handlers map[int64]chan WsgiRequestHandler = map[int64]chan WsgiRequestHandler{}
+// lookPathInVenv finds the executable name in the bin directory of the venv before
+// looking in PATH, so tools installed in the venv are used. Names with a path separator
+// are left as they are and resolve against the project directory.
+func lookPathInVenv(name string, venv_bin string) (string, error) {
+	if strings.ContainsRune(name, os.PathSeparator) {
+		return name, nil
+	}
+	if venv_bin != "" {
+		if path, err := exec.LookPath(filepath.Join(venv_bin, name)); err == nil {
+			return path, nil
+		}
+	}
+	return exec.LookPath(name)
+}
 
-func init() {
-	setup_py := C.CString(caddysnake_py)
-	defer C.free(unsafe.Pointer(setup_py))
-	C.Py_init_and_release_gil(setup_py)
-	caddy.RegisterModule(CaddySnake{})
-	httpcaddyfile.RegisterHandlerDirective("python", parsePythonDirective)
+// runStartupCommands runs the Django management commands and on_startup commands in the
+// project directory, with the app's venv and env, before the app is imported. A command
+// starting with python runs with the interpreter of the venv.
+func (f *CaddySnake) runStartupCommands(venv_path string) error {
+	commands := [][]string{}
+	if f.DjangoMigrate == "on" {
+		commands = append(commands, []string{"python", "manage.py", "migrate", "--noinput"})
+	}
+	if f.DjangoCollectstatic == "on" {
+		commands = append(commands, []string{"python", "manage.py", "collectstatic", "--noinput"})
+	}
+	commands = append(commands, f.OnStartup...)
+	if len(commands) == 0 {
+		return nil
+	}
+
+	env := os.Environ()
+	python := "python"
+	venv_bin := ""
+	if venv_path != "" {
+		venv_path, err := filepath.Abs(venv_path)
+		if err != nil {
+			return err
+		}
+		venv_bin = filepath.Join(venv_path, "bin")
+		env = append(env, "VIRTUAL_ENV="+venv_path, "PATH="+venv_bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	} else {
+		runtime.LockOSThread()
+		python = fmt.Sprintf("python3.%d", C.Py_minor_version())
+		runtime.UnlockOSThread()
+	}
+	if len(f.PythonPath) > 0 {
+		python_path := make([]string, 0, len(f.PythonPath))
+		for _, dir := range f.PythonPath {
+			// Commands run in the project directory, relative paths would point elsewhere
+			dir, err := filepath.Abs(dir)
+			if err != nil {
+				return err
+			}
+			python_path = append(python_path, dir)
+		}
+		env = append(env, "PYTHONPATH="+strings.Join(python_path, string(os.PathListSeparator)))
+	}
+	for key, value := range f.Env {
+		env = append(env, key+"="+value)
+	}
+
+	for _, args := range commands {
+		name := args[0]
+		if name == "python" {
+			name = python
+		}
+		path, err := lookPathInVenv(name, venv_bin)
+		if err != nil {
+			return fmt.Errorf("startup command %s failed: %w", strings.Join(args, " "), err)
+		}
+		f.logger.Info("running startup command", zap.Strings("command", args))
+		cmd := exec.Command(path, args[1:]...)
+		cmd.Dir = f.project_dir
+		cmd.Env = env
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("startup command %s failed: %w\n%s", strings.Join(args, " "), err, output)
+		}
+		f.logger.Debug("ran startup command", zap.Strings("command", args), zap.ByteString("output", output))
+	}
+	return nil
+}
+
+// detectInterface imports the app in pattern and reports whether it's an ASGI app,
+// otherwise it's treated as a WSGI app.
+func detectInterface(pattern string, venv_path string) (bool, error) {
+	module_app := strings.Split(pattern, ":")
+	if len(module_app) != 2 {
+		return false, errors.New("expected pattern $(MODULE_NAME):$(VARIABLE_NAME)")
+	}
+	module_name := C.CString(module_app[0])
+	defer C.free(unsafe.Pointer(module_name))
+	app_name := C.CString(module_app[1])
+	defer C.free(unsafe.Pointer(app_name))
+
+	var packages_path *C.char = nil
+	if venv_path != "" {
+		sitePackagesPath, err := findSitePackagesInVenv(venv_path)
+		if err != nil {
+			return false, err
+		}
+		packages_path = C.CString(sitePackagesPath)
+		defer C.free(unsafe.Pointer(packages_path))
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch C.Py_detect_interface(module_name, app_name, packages_path) {
+	case 1:
+		return true, nil
+	case 0:
+		return false, nil
+	default:
+		return false, errors.New("failed to import module")
+	}
 }
 
-// findSitePackagesInVenv searches for the site-packages directory in a given venv.
-// It returns the absolute path to the site-packages directory if found, or an error otherwise.
+// findSitePackagesInVenv searches for the site-packages directory in a given venv or conda
+// environment. It returns the absolute path to the site-packages directory if found, or an
+// error otherwise.
 func findSitePackagesInVenv(venvPath string) (string, error) {
 	libPath := filepath.Join(venvPath, "lib")
 	pythonDir, err := findPythonDirectory(libPath)
 	if err != nil {
+		// Windows layout, used by venv and conda
+		windowsPath := filepath.Join(venvPath, "Lib", "site-packages")
+		if info, statErr := os.Stat(windowsPath); statErr == nil && info.IsDir() {
+			return windowsPath, nil
+		}
 		return "", err
 	}
 	sitePackagesPath := filepath.Join(libPath, pythonDir, "site-packages")
@@ -196,35 +2219,89 @@ func findSitePackagesInVenv(venvPath string) (string, error) {
 }
 
 // findPythonDirectory searches for a directory that matches "python3.*" inside the given libPath.
+// The one for the embedded Python version is preferred, conda environments can have several.
 func findPythonDirectory(libPath string) (string, error) {
-	var pythonDir string
-	found := false
-	filepath.Walk(libPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	entries, err := os.ReadDir(libPath)
+	if err != nil {
+		return "", errors.New("unable to find a python3.* directory in the venv")
+	}
+	runtime.LockOSThread()
+	version := fmt.Sprintf("python3.%d", C.Py_minor_version())
+	runtime.UnlockOSThread()
+	pythonDir := ""
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
 		}
-		if !info.IsDir() || found {
-			return nil
+		name := entry.Name()
+		// Free-threaded builds use python3.Xt
+		if name == version || name == version+"t" {
+			return name, nil
 		}
-		matched, _ := regexp.MatchString(`python3\..*`, info.Name())
-		if matched {
-			pythonDir = info.Name()
-			found = true
-			// Use an error to stop walking the directory tree
-			return errors.New("python directory found")
+		if pythonDir == "" {
+			if matched, _ := regexp.MatchString(`python3\..*`, name); matched {
+				pythonDir = name
+			}
 		}
-		return nil
-	})
-	if !found || pythonDir == "" {
+	}
+	if pythonDir == "" {
 		return "", errors.New("unable to find a python3.* directory in the venv")
 	}
 	return pythonDir, nil
 }
 
+// defaultWsgiThreads is the number of threads that run WSGI requests when wsgi_threads isn't set
+const defaultWsgiThreads = 32
+
+// startWsgiThreads grows the pool of threads that run WSGI requests. The pool is shared by
+// all WSGI apps, so it ends up with the biggest wsgi_threads that was configured.
+func startWsgiThreads(count int) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	C.Wsgi_start_threads(C.int(count))
+}
+
+// newMapKeyVal copies pairs into a MapKeyVal. Keys and values are written straight into
+// the single block of C memory allocated by MapKeyVal_new, which is released with
+// MapKeyVal_free.
+func newMapKeyVal(pairs [][2]string) *C.MapKeyVal {
+	data_size := 0
+	for _, pair := range pairs {
+		data_size += len(pair[0]) + len(pair[1]) + 2
+	}
+	m := C.MapKeyVal_new(C.size_t(len(pairs)), C.size_t(data_size))
+	keys, values := mapKeyValSlices(m)
+	data := unsafe.Slice((*byte)(unsafe.Pointer(m.data)), data_size)
+	used := 0
+	copyString := func(s string) *C.char {
+		str := (*C.char)(unsafe.Pointer(&data[used]))
+		used += copy(data[used:], s)
+		data[used] = 0
+		used++
+		return str
+	}
+	for i, pair := range pairs {
+		keys[i] = copyString(pair[0])
+		values[i] = copyString(pair[1])
+	}
+	m.data_used = C.size_t(used)
+	return m
+}
+
+// mapKeyValSlices returns the keys and values of a MapKeyVal as slices backed by C memory
+func mapKeyValSlices(m *C.MapKeyVal) ([]*C.char, []*C.char) {
+	count := int(m.count)
+	return unsafe.Slice(m.keys, count), unsafe.Slice(m.values, count)
+}
+
 // Wsgi stores a reference to a Python Wsgi application
 type Wsgi struct {
 	app          *C.WsgiApp
 	wsgi_pattern string
+	app_stats    *appStats
+	// refs counts the handlers using the app, a config reload provisions the new
+	// handlers before cleaning up the old ones
+	refs int
 }
 
 var wsgiapp_cache map[string]*Wsgi = map[string]*Wsgi{}
@@ -235,6 +2312,7 @@ func NewWsgi(wsgi_pattern string, venv_path string) (*Wsgi, error) {
 	defer wsgi_lock.Unlock()
 
 	if app, ok := wsgiapp_cache[wsgi_pattern]; ok {
+		app.refs++
 		return app, nil
 	}
 
@@ -259,21 +2337,49 @@ func NewWsgi(wsgi_pattern string, venv_path string) (*Wsgi, error) {
 
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
-	app := C.WsgiApp_import(module_name, app_name, packages_path)
-	if app == nil {
-		return nil, errors.New("failed to import module")
+	app := C.WsgiApp_import(module_name, app_name, packages_path)
+	if app == nil {
+		return nil, errors.New("failed to import module")
+	}
+
+	result := &Wsgi{app, wsgi_pattern, newAppStats(wsgi_pattern, venv_path), 1}
+	wsgiapp_cache[wsgi_pattern] = result
+	return result, nil
+}
+
+func (m *Wsgi) stats() *appStats {
+	return m.app_stats
+}
+
+// Reload imports the app again, running requests finish with the previous one. The app's
+// top-level package is dropped from sys.modules, so changes to any of its modules are seen.
+func (m *Wsgi) Reload() error {
+	module_app := strings.Split(m.wsgi_pattern, ":")
+	module_name := C.CString(module_app[0])
+	defer C.free(unsafe.Pointer(module_name))
+	app_name := C.CString(module_app[1])
+	defer C.free(unsafe.Pointer(app_name))
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.WsgiApp_reload(m.app, module_name, app_name) == 0 {
+		return errors.New("failed to reload module")
 	}
-
-	result := &Wsgi{app, wsgi_pattern}
-	wsgiapp_cache[wsgi_pattern] = result
-	return result, nil
+	m.app_stats.reloaded()
+	return nil
 }
 
-// Cleanup deallocates CGO resources used by Wsgi app
+// Cleanup releases the app, the CGO resources are freed when the last handler using
+// it is cleaned up
 func (m *Wsgi) Cleanup() error {
 	if m.app != nil {
 		wsgi_lock.Lock()
-		if _, ok := wsgiapp_cache[m.wsgi_pattern]; !ok {
+		if wsgiapp_cache[m.wsgi_pattern] != m {
+			wsgi_lock.Unlock()
+			return nil
+		}
+		m.refs--
+		if m.refs > 0 {
 			wsgi_lock.Unlock()
 			return nil
 		}
@@ -300,6 +2406,86 @@ func upperCaseAndUnderscore(r rune) rune {
 	return r
 }
 
+// isTrustedProxy reports whether addr belongs to one of the trusted_proxies ranges
+func (opts requestOptions) isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range opts.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromTrustedProxy reports whether the request was sent by one of the trusted_proxies
+func fromTrustedProxy(r *http.Request) bool {
+	opts := getRequestOptions(r)
+	if len(opts.trustedProxies) == 0 {
+		return false
+	}
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	return err == nil && opts.isTrustedProxy(peer.Addr())
+}
+
+// forwardedFor returns the client address from X-Forwarded-For. The list is walked from
+// right to left skipping the trusted proxies, so addresses added by the client can't be
+// used to spoof it.
+func forwardedFor(r *http.Request) string {
+	opts := getRequestOptions(r)
+	values := r.Header.Values("X-Forwarded-For")
+	client := ""
+	for i := len(values) - 1; i >= 0; i-- {
+		hops := strings.Split(values[i], ",")
+		for j := len(hops) - 1; j >= 0; j-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[j]))
+			if err != nil {
+				return client
+			}
+			client = addr.Unmap().String()
+			if !opts.isTrustedProxy(addr) {
+				return client
+			}
+		}
+	}
+	return client
+}
+
+// requestScheme returns http or https. X-Forwarded-Proto is used when the request
+// comes from one of the trusted_proxies.
+func requestScheme(r *http.Request) string {
+	if fromTrustedProxy(r) {
+		proto := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto")))
+		if proto == "http" || proto == "https" {
+			return proto
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// clientAddress returns the host and port of the client. When the request comes from one
+// of the trusted_proxies the host is taken from X-Forwarded-For, otherwise it's Caddy's
+// client_ip, which honors the trusted_proxies of the server. The port is only known when
+// the client is connected directly. Both are empty when the client address isn't known
+// (e.g. unix sockets).
+func clientAddress(r *http.Request) (string, string) {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host, port = "", ""
+	}
+	if fromTrustedProxy(r) {
+		if client := forwardedFor(r); client != "" {
+			return client, ""
+		}
+	}
+	if client_ip, ok := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string); ok && client_ip != "" && client_ip != host {
+		return client_ip, ""
+	}
+	return host, port
+}
+
 // HandleRequest passes request down to Python Wsgi app and writes responses and headers.
 func (m *Wsgi) HandleRequest(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
@@ -316,31 +2502,34 @@ func (m *Wsgi) HandleRequest(w http.ResponseWriter, r *http.Request) error {
 		"SERVER_PROTOCOL": r.Proto,
 		"X_FROM":          "caddy-snake",
 		"REQUEST_METHOD":  r.Method,
-		"SCRIPT_NAME":     "",
+		"SCRIPT_NAME":     getRequestOptions(r).rootPath,
 		"PATH_INFO":       r.URL.Path,
 		"QUERY_STRING":    r.URL.RawQuery,
 		"CONTENT_TYPE":    r.Header.Get("Content-type"),
 		"CONTENT_LENGTH":  r.Header.Get("Content-length"),
-		"wsgi.url_scheme": strings.ToLower(strings.Split(r.Proto, "/")[0]),
-	}
-	headers_length := len(r.Header)
-	if _, ok := r.Header[textproto.CanonicalMIMEHeaderKey("Proxy")]; ok {
-		headers_length -= 1
-	}
-	if _, ok := r.Header[textproto.CanonicalMIMEHeaderKey("Content-Type")]; ok {
-		headers_length -= 1
-	}
-	if _, ok := r.Header[textproto.CanonicalMIMEHeaderKey("Content-Length")]; ok {
-		headers_length -= 1
-	}
-	rh := C.MapKeyVal_new(C.size_t(headers_length + len(extra_headers)))
-	defer C.free(unsafe.Pointer(rh))
-	defer C.free(unsafe.Pointer(rh.keys))
-	defer C.free(unsafe.Pointer(rh.values))
-	i := 0
-	size_of_char_pointer := unsafe.Sizeof(rh.keys)
-	base_headers := uintptr(unsafe.Pointer(rh.keys))
-	base_values := uintptr(unsafe.Pointer(rh.values))
+		"wsgi.url_scheme": requestScheme(r),
+	}
+	remote_addr, remote_port := clientAddress(r)
+	extra_headers["REMOTE_ADDR"] = remote_addr
+	if remote_port != "" {
+		extra_headers["REMOTE_PORT"] = remote_port
+	}
+	if extra_headers["wsgi.url_scheme"] == "https" {
+		extra_headers["HTTPS"] = "on"
+	}
+	if r.TLS != nil {
+		// Same variables as Apache mod_ssl, used by mTLS middlewares
+		extra_headers["SSL_CLIENT_VERIFY"] = "NONE"
+		if len(r.TLS.PeerCertificates) > 0 {
+			cert := r.TLS.PeerCertificates[0]
+			extra_headers["SSL_CLIENT_VERIFY"] = "SUCCESS"
+			extra_headers["SSL_CLIENT_S_DN"] = cert.Subject.String()
+			extra_headers["SSL_CLIENT_I_DN"] = cert.Issuer.String()
+			extra_headers["SSL_CLIENT_M_SERIAL"] = fmt.Sprintf("%X", cert.SerialNumber)
+			extra_headers["SSL_CLIENT_CERT"] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+		}
+	}
+	environ := make([][2]string, 0, len(r.Header)+len(extra_headers))
 	for k, items := range r.Header {
 		key := strings.Map(upperCaseAndUnderscore, k)
 		if key == "PROXY" {
@@ -359,84 +2548,280 @@ func (m *Wsgi) HandleRequest(w http.ResponseWriter, r *http.Request) error {
 		if k == "COOKIE" {
 			joinStr = "; "
 		}
-
-		key_str := C.CString("HTTP_" + key)
-		defer C.free(unsafe.Pointer(key_str))
-		value_str := C.CString(strings.Join(items, joinStr))
-		defer C.free(unsafe.Pointer(value_str))
-		*(**C.char)(unsafe.Pointer(base_headers + uintptr(i)*size_of_char_pointer)) = key_str
-		*(**C.char)(unsafe.Pointer(base_values + uintptr(i)*size_of_char_pointer)) = value_str
-		i++
+		environ = append(environ, [2]string{"HTTP_" + key, strings.Join(items, joinStr)})
 	}
 	for k, v := range extra_headers {
-		key_str := C.CString(k)
-		defer C.free(unsafe.Pointer(key_str))
-		value_str := C.CString(v)
-		defer C.free(unsafe.Pointer(value_str))
-		*(**C.char)(unsafe.Pointer(base_headers + uintptr(i)*size_of_char_pointer)) = key_str
-		*(**C.char)(unsafe.Pointer(base_values + uintptr(i)*size_of_char_pointer)) = value_str
-		i++
+		environ = append(environ, [2]string{k, v})
 	}
+	rh := newMapKeyVal(environ)
+	defer C.MapKeyVal_free(rh)
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		return err
+	// The body is read by the app through wsgi.input, see wsgi_read_body
+	var body io.Reader = r.Body
+	if threshold := getRequestOptions(r).spoolThreshold; threshold > 0 {
+		spooled, cleanup, err := spoolBody(r.Body, threshold)
+		if err != nil {
+			return requestBodyError(err)
+		}
+		defer cleanup()
+		body = spooled
 	}
-	body_str := C.CString(string(body))
-	defer C.free(unsafe.Pointer(body_str))
 
-	ch := make(chan WsgiRequestHandler)
-	wsgi_lock.Lock()
-	wsgi_request_counter++
-	request_id := wsgi_request_counter
-	wsgi_handlers[request_id] = ch
-	wsgi_lock.Unlock()
+	h := &WsgiRequestHandler{
+		body:      body,
+		responses: make(chan WsgiResponse),
+		written:   make(chan bool, 1),
+		done:      make(chan struct{}),
+	}
+	request_id := wsgi_state.Request(h)
+	h.logger = getRequestOptions(r).logger.With(zap.String("app", m.wsgi_pattern), zap.Int64("request_id", request_id))
+	defer func() {
+		// The app may still be reading the body after a timeout or a disconnect
+		h.closeBody()
+		wsgi_state.Cleanup(request_id)
+		// Unblock the Python thread if it's waiting to write
+		close(h.done)
+	}()
 
 	runtime.LockOSThread()
-	C.WsgiApp_handle_request(m.app, C.int64_t(request_id), rh, body_str)
+	req := C.WsgiApp_handle_request(m.app, C.int64_t(request_id), rh)
 	runtime.UnlockOSThread()
+	defer func() {
+		runtime.LockOSThread()
+		C.RequestResponse_cleanup(req)
+		runtime.UnlockOSThread()
+	}()
+
+	timeout, stop_timer := getRequestOptions(r).timeoutChan()
+	defer stop_timer()
 
-	h := <-ch
+	started := false
+	for {
+		var resp WsgiResponse
+		select {
+		case resp = <-h.responses:
+		case <-ctx.Done():
+			// Client went away, the app stops at the next write
+			return nil
+		case <-timeout:
+			runtime.LockOSThread()
+			C.RequestResponse_cancel(req)
+			runtime.UnlockOSThread()
+			return errTimeout
+		}
 
-	if h.headers != nil {
-		defer C.free(unsafe.Pointer(h.headers))
-		defer C.free(unsafe.Pointer(h.headers.keys))
-		defer C.free(unsafe.Pointer(h.headers.values))
+		if !started {
+			setWorkerPlaceholder(r, C.GoString(C.RequestResponse_worker(req)))
+		}
 
-		for i := 0; i < int(h.headers.count); i++ {
-			header_name_ptr := unsafe.Pointer(uintptr(unsafe.Pointer(h.headers.keys)) + uintptr(i)*size_of_char_pointer)
-			header_value_ptr := unsafe.Pointer(uintptr(unsafe.Pointer(h.headers.values)) + uintptr(i)*size_of_char_pointer)
-			header_name := *(**C.char)(header_name_ptr)
-			defer C.free(unsafe.Pointer(header_name))
-			header_value := *(**C.char)(header_value_ptr)
-			defer C.free(unsafe.Pointer(header_value))
-			w.Header().Add(C.GoString(header_name), C.GoString(header_value))
+		if resp.file != nil {
+			addWsgiHeaders(w.Header(), resp.headers)
+			serveWsgiFile(w, r, int(resp.status_code), resp.file)
+			h.written <- true
+			return nil
 		}
-	}
 
-	w.WriteHeader(int(h.status_code))
+		if !started {
+			// The app failed to read the body, the error is passed to the client
+			// if it was too large. Read errors happen before the response is sent.
+			if isBodyTooLarge(h.body_err) {
+				h.written <- false
+				return requestBodyError(h.body_err)
+			}
+			started = true
+			addWsgiHeaders(w.Header(), resp.headers)
+			w.WriteHeader(int(resp.status_code))
+			if resp.headers == nil && resp.status_code == 500 {
+				w.Write([]byte("Interal Server Error"))
+			}
+		}
 
-	if h.body != nil {
-		defer C.free(unsafe.Pointer(h.body))
-		w.Write([]byte(C.GoString(h.body)))
-	} else if h.status_code == 500 {
-		w.Write([]byte("Interal Server Error"))
+		_, err := w.Write(resp.body)
+		if err == nil && resp.more_body {
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+		h.written <- err == nil
+		if err != nil || !resp.more_body {
+			return nil
+		}
 	}
+}
 
-	return nil
+// asgiWorker is the name of the thread that runs the event loop, see start_event_loop
+// in caddysnake.py. Every ASGI request runs as a task of that loop.
+const asgiWorker = "caddysnake-asgi-loop"
+
+// setWorkerPlaceholder sets {http.handlers.python.worker} to the thread that runs the
+// request
+func setWorkerPlaceholder(r *http.Request, worker string) {
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Set("http.handlers.python.worker", worker)
+	}
 }
 
 //export wsgi_write_response
-func wsgi_write_response(request_id C.int64_t, status_code C.int, headers *C.MapKeyVal, body *C.char) {
-	wsgi_lock.Lock()
-	defer wsgi_lock.Unlock()
-	ch := wsgi_handlers[int64(request_id)]
-	ch <- WsgiRequestHandler{
+func wsgi_write_response(request_id C.int64_t, status_code C.int, headers *C.MapKeyVal, body *C.char, body_len C.size_t, more_body C.uint8_t) C.int {
+	h, ok := wsgi_state.Get(int64(request_id))
+	if !ok {
+		return 0
+	}
+	resp := WsgiResponse{
+		status_code: status_code,
+		headers:     headers,
+		more_body:   more_body == 1,
+	}
+	if body_len > 0 {
+		// The Python thread waits until the chunk is written, so it's used without a copy
+		resp.body = unsafe.Slice((*byte)(unsafe.Pointer(body)), int(body_len))
+	}
+	select {
+	case h.responses <- resp:
+		if <-h.written {
+			return 1
+		}
+	case <-h.done:
+	}
+	return 0
+}
+
+//export wsgi_send_file
+func wsgi_send_file(request_id C.int64_t, status_code C.int, headers *C.MapKeyVal, fd C.int, name *C.char) {
+	file := os.NewFile(uintptr(fd), C.GoString(name))
+	h, ok := wsgi_state.Get(int64(request_id))
+	if !ok {
+		file.Close()
+		return
+	}
+	resp := WsgiResponse{
 		status_code: status_code,
-		body:        body,
 		headers:     headers,
+		file:        file,
+	}
+	select {
+	case h.responses <- resp:
+		<-h.written
+	case <-h.done:
+		file.Close()
+	}
+}
+
+// serveWsgiFile writes a file returned by the app through wsgi.file_wrapper and closes it.
+// Regular files are served with http.ServeContent, which uses sendfile and handles range
+// and conditional requests.
+func serveWsgiFile(w http.ResponseWriter, r *http.Request, status_code int, file *os.File) {
+	defer file.Close()
+	if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+		http.ServeContent(w, r, file.Name(), info.ModTime(), file)
+		return
+	}
+	w.WriteHeader(status_code)
+	io.Copy(w, file)
+}
+
+// addWsgiHeaders adds headers received from the WSGI app to h
+func addWsgiHeaders(h http.Header, headers *C.MapKeyVal) {
+	if headers == nil {
+		return
+	}
+	keys, values := mapKeyValSlices(headers)
+	for i := range keys {
+		h.Add(C.GoString(keys[i]), C.GoString(values[i]))
+	}
+}
+
+//export wsgi_log
+func wsgi_log(request_id C.int64_t, message *C.char) {
+	logger := pythonLogger()
+	if h, ok := wsgi_state.Get(int64(request_id)); ok {
+		logger = h.logger
 	}
-	delete(wsgi_handlers, int64(request_id))
+	logger.Error(C.GoString(message))
+}
+
+// pythonLogLevel maps a level of the logging module to a zap level
+func pythonLogLevel(level int) zapcore.Level {
+	switch {
+	case level < 20:
+		return zapcore.DebugLevel
+	case level < 30:
+		return zapcore.InfoLevel
+	case level < 40:
+		return zapcore.WarnLevel
+	default:
+		return zapcore.ErrorLevel
+	}
+}
+
+//export python_log
+func python_log(request_id C.int64_t, level C.int, name *C.char, message *C.char, extras *C.MapKeyVal) {
+	logger := pythonLogger()
+	if h, ok := wsgi_state.Get(int64(request_id)); ok {
+		logger = h.logger
+	}
+	entry := logger.Check(pythonLogLevel(int(level)), C.GoString(message))
+	if entry == nil {
+		return
+	}
+	keys, values := mapKeyValSlices(extras)
+	fields := make([]zap.Field, 0, len(keys)+1)
+	fields = append(fields, zap.String("logger", C.GoString(name)))
+	for i := range keys {
+		fields = append(fields, zap.String(C.GoString(keys[i]), C.GoString(values[i])))
+	}
+	entry.Write(fields...)
+}
+
+//export wsgi_read_body
+func wsgi_read_body(request_id C.int64_t, buf *C.char, size C.size_t) C.int64_t {
+	h, ok := wsgi_state.Get(int64(request_id))
+	if !ok || size == 0 {
+		return 0
+	}
+	h.body_lock.Lock()
+	defer h.body_lock.Unlock()
+	if h.body_closed {
+		return -1
+	}
+	n, err := io.ReadAtLeast(h.body, unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(size)), 1)
+	if err == io.EOF {
+		return 0
+	} else if err != nil {
+		h.body_err = err
+		return -1
+	}
+	return C.int64_t(n)
+}
+
+// spoolBody reads the whole request body before it's passed to the app. Bodies up to
+// threshold bytes are kept in memory and bigger ones are written to a temporary file.
+func spoolBody(body io.Reader, threshold int64) (io.Reader, func(), error) {
+	buf, err := io.ReadAll(io.LimitReader(body, threshold+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(buf)) <= threshold {
+		return bytes.NewReader(buf), func() {}, nil
+	}
+	f, err := os.CreateTemp("", "caddysnake-body-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if _, err = f.Write(buf); err == nil {
+		if _, err = io.Copy(f, body); err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return f, cleanup, nil
 }
 
 // ASGI: Implementation
@@ -445,16 +2830,34 @@ func wsgi_write_response(request_id C.int64_t, status_code C.int, headers *C.Map
 type Asgi struct {
 	app          *C.AsgiApp
 	asgi_pattern string
+	app_stats    *appStats
+	// refs counts the handlers using the app, like Wsgi.refs
+	refs int
 }
 
 var asgiapp_cache map[string]*Asgi = map[string]*Asgi{}
 
-// NewAsgi imports a Python ASGI app
-func NewAsgi(asgi_pattern string, venv_path string, lifespan bool) (*Asgi, error) {
+// asgi_event_loop is the kind of loop running the ASGI apps, set when the first one is
+// imported
+var asgi_event_loop string
+
+// setAsgiExecutorThreads sets the size of the default executor of the event loop, which
+// runs sync endpoints. It's shared by all ASGI apps, so it ends up with the biggest
+// asgi_executor_threads that was configured.
+func setAsgiExecutorThreads(count int) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	C.Asgi_set_executor_threads(C.int(count))
+}
+
+// NewAsgi imports a Python ASGI app. The event loop is started with the first app,
+// event_loop is ignored for the ones imported after it.
+func NewAsgi(asgi_pattern string, venv_path string, lifespan bool, event_loop string) (*Asgi, error) {
 	asgi_lock.Lock()
 	defer asgi_lock.Unlock()
 
 	if app, ok := asgiapp_cache[asgi_pattern]; ok {
+		app.refs++
 		return app, nil
 	}
 
@@ -484,25 +2887,66 @@ func NewAsgi(asgi_pattern string, venv_path string, lifespan bool) (*Asgi, error
 		return nil, errors.New("failed to import module")
 	}
 
-	var err error
+	event_loop_str := C.CString(event_loop)
+	defer C.free(unsafe.Pointer(event_loop_str))
+	var running [16]C.char
+	if C.Asgi_start_event_loop(event_loop_str, &running[0], C.size_t(len(running))) == 0 {
+		C.AsgiApp_cleanup(app)
+		return nil, fmt.Errorf("failed to start %s event loop", event_loop)
+	}
+	asgi_event_loop = C.GoString(&running[0])
 
 	if lifespan {
 		status := C.AsgiApp_lifespan_startup(app)
 		if uint8(status) == 0 {
-			err = errors.New("startup failed")
+			// Not cached, the handler fails to provision and never releases it
+			C.AsgiApp_cleanup(app)
+			return nil, errors.New("startup failed")
 		}
 	}
 
-	result := &Asgi{app, asgi_pattern}
+	result := &Asgi{app, asgi_pattern, newAppStats(asgi_pattern, venv_path), 1}
 	asgiapp_cache[asgi_pattern] = result
-	return result, err
+	return result, nil
+}
+
+func (m *Asgi) stats() *appStats {
+	return m.app_stats
+}
+
+// Reload imports the app again, running requests finish with the previous one. When lifespan
+// is enabled, the previous app is shut down and the new one is started.
+func (m *Asgi) Reload() error {
+	module_app := strings.Split(m.asgi_pattern, ":")
+	module_name := C.CString(module_app[0])
+	defer C.free(unsafe.Pointer(module_name))
+	app_name := C.CString(module_app[1])
+	defer C.free(unsafe.Pointer(app_name))
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch C.AsgiApp_reload(m.app, module_name, app_name) {
+	case 0:
+		return errors.New("failed to reload module")
+	case -1:
+		m.app_stats.reloaded()
+		return errors.New("startup failed")
+	}
+	m.app_stats.reloaded()
+	return nil
 }
 
-// Cleanup deallocates CGO resources used by Asgi app
+// Cleanup releases the app, when the last handler using it is cleaned up the lifespan
+// shutdown runs and the CGO resources are freed
 func (m *Asgi) Cleanup() (err error) {
 	if m.app != nil {
 		asgi_lock.Lock()
-		if _, ok := asgiapp_cache[m.asgi_pattern]; !ok {
+		if asgiapp_cache[m.asgi_pattern] != m {
+			asgi_lock.Unlock()
+			return
+		}
+		m.refs--
+		if m.refs > 0 {
 			asgi_lock.Unlock()
 			return
 		}
@@ -524,13 +2968,16 @@ func (m *Asgi) Cleanup() (err error) {
 
 // AsgiRequestHandler stores pointers to the request and the response writer
 type AsgiRequestHandler struct {
-	w    http.ResponseWriter
-	r    *http.Request
-	done chan error
+	w      http.ResponseWriter
+	r      *http.Request
+	done   chan error
+	logger *zap.Logger
 
 	operations chan AsgiOperations
+	stopped    chan struct{}
 
 	is_websocket bool
+	trailers     bool
 }
 
 // AsgiOperations stores operations that should be executed in the background
@@ -540,6 +2987,7 @@ type AsgiOperations struct {
 }
 
 func (h *AsgiRequestHandler) consume() {
+	defer close(h.stopped)
 	for {
 		o := <-h.operations
 		if o.op != nil {
@@ -560,6 +3008,7 @@ func NewAsgiRequestHandler(w http.ResponseWriter, r *http.Request) *AsgiRequestH
 		done: make(chan error, 2),
 
 		operations: make(chan AsgiOperations, 4),
+		stopped:    make(chan struct{}),
 	}
 	go h.consume()
 	return h
@@ -569,23 +3018,40 @@ var asgi_lock sync.RWMutex = sync.RWMutex{}
 var asgi_request_counter uint64 = 0
 var asgi_handlers map[uint64]*AsgiRequestHandler = map[uint64]*AsgiRequestHandler{}
 
+// asgiHttpVersion returns the HTTP version in the format expected by the ASGI scope:
+// "1.0", "1.1", "2" or "3".
+func asgiHttpVersion(r *http.Request) string {
+	if r.ProtoMajor >= 2 {
+		return strconv.Itoa(r.ProtoMajor)
+	}
+	return fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)
+}
+
 // HandleRequest passes request down to Python ASGI app and writes responses and headers.
 func (m *Asgi) HandleRequest(w http.ResponseWriter, r *http.Request) error {
+	setWorkerPlaceholder(r, asgiWorker)
 	ctx := r.Context()
 	srvAddr := ctx.Value(http.LocalAddrContextKey).(net.Addr)
-	_, server_port_string, _ := net.SplitHostPort(srvAddr.String())
+	_, server_port_string, server_err := net.SplitHostPort(srvAddr.String())
 	server_port, _ := strconv.Atoi(server_port_string)
 	server_host, _, _ := net.SplitHostPort(r.Host)
 	if server_host == "" {
 		// net.SplitHostPort returns error and an empty host when port is missing
 		server_host = r.Host
 	}
-	server_host_str := C.CString(server_host)
-	defer C.free(unsafe.Pointer(server_host_str))
-	client_host, client_port_string, _ := net.SplitHostPort(r.RemoteAddr)
+	// Server and client are None in the scope when they're not known (e.g. unix sockets)
+	var server_host_str *C.char = nil
+	if server_err == nil {
+		server_host_str = C.CString(server_host)
+		defer C.free(unsafe.Pointer(server_host_str))
+	}
+	client_host, client_port_string := clientAddress(r)
 	client_port, _ := strconv.Atoi(client_port_string)
-	client_host_str := C.CString(client_host)
-	defer C.free(unsafe.Pointer(client_host_str))
+	var client_host_str *C.char = nil
+	if client_host != "" {
+		client_host_str = C.CString(client_host)
+		defer C.free(unsafe.Pointer(client_host_str))
+	}
 
 	is_websocket := r.Header.Get("connection") == "Upgrade" && r.Header.Get("upgrade") == "websocket" && r.Method == "GET"
 
@@ -597,69 +3063,69 @@ func (m *Asgi) HandleRequest(w http.ResponseWriter, r *http.Request) error {
 	if is_websocket {
 		conn_type = "websocket"
 		scheme = "ws"
-		if r.TLS != nil {
+		if requestScheme(r) == "https" {
 			scheme = "wss"
 		}
 	} else {
 		conn_type = "http"
-		scheme = "http"
-		if r.TLS != nil {
-			scheme = "https"
-		}
+		scheme = requestScheme(r)
 	}
 	scope_map := map[string]string{
 		"type":         conn_type,
-		"http_version": fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor),
+		"http_version": asgiHttpVersion(r),
 		"method":       r.Method,
 		"scheme":       scheme,
 		"path":         decodedPath,
 		"raw_path":     r.URL.EscapedPath(),
 		"query_string": r.URL.RawQuery,
-		"root_path":    "",
-	}
-	scope := C.MapKeyVal_new(C.size_t(len(scope_map)))
-	defer C.free(unsafe.Pointer(scope))
-	defer C.free(unsafe.Pointer(scope.keys))
-	defer C.free(unsafe.Pointer(scope.values))
-	scope_count := 0
-	base_of_keys := uintptr(unsafe.Pointer(scope.keys))
-	base_of_values := uintptr(unsafe.Pointer(scope.values))
-	size_of_pointer := unsafe.Sizeof(scope.keys)
+		"root_path":    getRequestOptions(r).rootPath,
+	}
+	scope_pairs := make([][2]string, 0, len(scope_map))
 	for k, v := range scope_map {
-		key_str := C.CString(k)
-		defer C.free(unsafe.Pointer(key_str))
-		value_str := C.CString(v)
-		defer C.free(unsafe.Pointer(value_str))
-		*(**C.char)(unsafe.Pointer(base_of_keys + uintptr(scope_count)*size_of_pointer)) = key_str
-		*(**C.char)(unsafe.Pointer(base_of_values + uintptr(scope_count)*size_of_pointer)) = value_str
-		scope_count++
-	}
-
-	request_headers := C.MapKeyVal_new(C.size_t(len(r.Header)))
-	defer C.free(unsafe.Pointer(request_headers))
-	defer C.free(unsafe.Pointer(request_headers.keys))
-	defer C.free(unsafe.Pointer(request_headers.values))
-	header_count := 0
-	base_of_keys = uintptr(unsafe.Pointer(request_headers.keys))
-	base_of_values = uintptr(unsafe.Pointer(request_headers.values))
+		scope_pairs = append(scope_pairs, [2]string{k, v})
+	}
+	scope := newMapKeyVal(scope_pairs)
+	defer C.MapKeyVal_free(scope)
+
+	// Each header value is sent as a separate (name, value) pair, as
+	// required by the ASGI spec. Cookies are the exception, they're
+	// joined so frameworks see a single cookie header.
+	header_pairs := [][2]string{}
 	for k, items := range r.Header {
 		if k == "Proxy" {
 			// golang cgi issue 16405
 			continue
 		}
 
-		joinStr := ", "
+		name := strings.ToLower(k)
 		if k == "Cookie" {
-			joinStr = "; "
+			header_pairs = append(header_pairs, [2]string{name, strings.Join(items, "; ")})
+			continue
 		}
+		for _, v := range items {
+			header_pairs = append(header_pairs, [2]string{name, v})
+		}
+	}
 
-		key_str := C.CString(strings.ToLower(k))
-		defer C.free(unsafe.Pointer(key_str))
-		value_str := C.CString(strings.Join(items, joinStr))
-		defer C.free(unsafe.Pointer(value_str))
-		*(**C.char)(unsafe.Pointer(base_of_keys + uintptr(header_count)*size_of_pointer)) = key_str
-		*(**C.char)(unsafe.Pointer(base_of_values + uintptr(header_count)*size_of_pointer)) = value_str
-		header_count++
+	request_headers := newMapKeyVal(header_pairs)
+	defer C.MapKeyVal_free(request_headers)
+
+	var tls_info *C.MapKeyVal = nil
+	if r.TLS != nil {
+		tls_pairs := [][2]string{
+			{"tls_version", strconv.Itoa(int(r.TLS.Version))},
+			{"cipher_suite", strconv.Itoa(int(r.TLS.CipherSuite))},
+			{"server_name", r.TLS.ServerName},
+		}
+		if len(r.TLS.PeerCertificates) > 0 {
+			tls_pairs = append(tls_pairs, [2]string{"client_cert_name", r.TLS.PeerCertificates[0].Subject.String()})
+		}
+		for _, cert := range r.TLS.PeerCertificates {
+			cert_pem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+			tls_pairs = append(tls_pairs, [2]string{"client_cert_chain", string(cert_pem)})
+		}
+		tls_info = newMapKeyVal(tls_pairs)
+		defer C.MapKeyVal_free(tls_info)
 	}
 
 	arh := NewAsgiRequestHandler(w, r)
@@ -668,17 +3134,12 @@ func (m *Asgi) HandleRequest(w http.ResponseWriter, r *http.Request) error {
 	asgi_lock.Lock()
 	asgi_request_counter++
 	request_id := asgi_request_counter
+	arh.logger = getRequestOptions(r).logger.With(zap.String("app", m.asgi_pattern), zap.Uint64("request_id", request_id))
 	asgi_handlers[request_id] = arh
 	asgi_lock.Unlock()
-	defer func() {
-		arh.operations <- AsgiOperations{stop: true}
-		asgi_lock.Lock()
-		delete(asgi_handlers, request_id)
-		asgi_lock.Unlock()
-	}()
 
 	runtime.LockOSThread()
-	C.AsgiApp_handle_request(
+	event := C.AsgiApp_handle_request(
 		m.app,
 		C.uint64_t(request_id),
 		scope,
@@ -687,65 +3148,138 @@ func (m *Asgi) HandleRequest(w http.ResponseWriter, r *http.Request) error {
 		C.int(client_port),
 		server_host_str,
 		C.int(server_port),
+		tls_info,
 	)
 	runtime.UnlockOSThread()
 
-	if err := <-arh.done; err != nil {
+	defer func() {
+		// Unregister first so no more operations are queued for this request
+		asgi_lock.Lock()
+		delete(asgi_handlers, request_id)
+		asgi_lock.Unlock()
+		arh.operations <- AsgiOperations{stop: true}
+		// Wait until pending operations finish using the response writer
+		for waiting := true; waiting; {
+			select {
+			case <-arh.stopped:
+				waiting = false
+			case <-arh.done:
+			}
+		}
+
+		runtime.LockOSThread()
+		// A receive after the response is finished gets an http.disconnect
+		C.AsgiEvent_disconnect(event)
+		C.AsgiEvent_cleanup(event)
+		runtime.UnlockOSThread()
+	}()
+
+	timeout, stop_timer := getRequestOptions(r).timeoutChan()
+	defer stop_timer()
+
+	select {
+	case err := <-arh.done:
 		return err
+	case <-ctx.Done():
+		// Client went away, let the app know through an http.disconnect event
+		runtime.LockOSThread()
+		C.AsgiEvent_disconnect(event)
+		runtime.UnlockOSThread()
+		return nil
+	case <-timeout:
+		runtime.LockOSThread()
+		C.AsgiEvent_cancel(event)
+		runtime.UnlockOSThread()
+		return errTimeout
 	}
-
-	return nil
 }
 
 //export asgi_receive_start
 func asgi_receive_start(request_id C.uint64_t, event *C.AsgiEvent) {
 	asgi_lock.Lock()
 	defer asgi_lock.Unlock()
-	arh := asgi_handlers[uint64(request_id)]
+	arh, ok := asgi_handlers[uint64(request_id)]
+	if !ok {
+		// Request already finished, unblock the app
+		C.AsgiEvent_set_receive(event, nil, 0, 0)
+		return
+	}
 
 	arh.operations <- AsgiOperations{op: func() {
-		body, err := io.ReadAll(arh.r.Body)
+		// Only one chunk is read per receive call, so the app paces the upload
+		chunk_size := getRequestOptions(arh.r).bodyChunkSize
+		buf := asgiBodyBuffer(chunk_size)
+		defer asgi_body_pool.Put(buf)
+
+		n, err := io.ReadFull(arh.r.Body, *buf)
+		more_body := C.uint8_t(1)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			more_body, err = 0, nil
+		}
 		if err != nil {
-			arh.done <- err
+			arh.done <- requestBodyError(err)
 			return
 		}
-		body_str := C.CString(string(body))
-		defer C.free(unsafe.Pointer(body_str))
 
 		runtime.LockOSThread()
-		C.AsgiEvent_set(event, body_str)
+		C.AsgiEvent_set_receive(event, (*C.char)(unsafe.Pointer(&(*buf)[0])), C.size_t(n), more_body)
 		runtime.UnlockOSThread()
 	}}
 }
 
+// asgi_body_pool keeps the buffers used to read request bodies for ASGI apps
+var asgi_body_pool sync.Pool
+
+// asgiBodyBuffer returns a buffer from the pool with exactly size bytes
+func asgiBodyBuffer(size int) *[]byte {
+	if buf, ok := asgi_body_pool.Get().(*[]byte); ok && cap(*buf) >= size {
+		*buf = (*buf)[:size]
+		return buf
+	}
+	buf := make([]byte, size)
+	return &buf
+}
+
+// addAsgiHeaders adds headers received from the ASGI app to h, prefixing their names
+// with prefix, and frees the C memory used by them.
+func addAsgiHeaders(h http.Header, headers *C.MapKeyVal, prefix string) {
+	if headers == nil {
+		return
+	}
+	defer C.MapKeyVal_free(headers)
+	keys, values := mapKeyValSlices(headers)
+	for i := range keys {
+		h.Add(prefix+C.GoString(keys[i]), C.GoString(values[i]))
+	}
+}
+
 //export asgi_set_headers
-func asgi_set_headers(request_id C.uint64_t, status_code C.int, headers *C.MapKeyVal, event *C.AsgiEvent) {
+func asgi_set_headers(request_id C.uint64_t, status_code C.int, headers *C.MapKeyVal, trailers C.uint8_t, event *C.AsgiEvent) {
 	asgi_lock.Lock()
 	defer asgi_lock.Unlock()
-	arh := asgi_handlers[uint64(request_id)]
+	arh, ok := asgi_handlers[uint64(request_id)]
+	if !ok {
+		// Request already finished, unblock the app
+		addAsgiHeaders(http.Header{}, headers, "")
+		C.AsgiEvent_set(event)
+		return
+	}
 
 	arh.operations <- AsgiOperations{op: func() {
-		if headers != nil {
-			size_of_pointer := unsafe.Sizeof(headers.keys)
-			defer C.free(unsafe.Pointer(headers))
-			defer C.free(unsafe.Pointer(headers.keys))
-			defer C.free(unsafe.Pointer(headers.values))
-
-			for i := 0; i < int(headers.count); i++ {
-				header_name_ptr := unsafe.Pointer(uintptr(unsafe.Pointer(headers.keys)) + uintptr(i)*size_of_pointer)
-				header_value_ptr := unsafe.Pointer(uintptr(unsafe.Pointer(headers.values)) + uintptr(i)*size_of_pointer)
-				header_name := *(**C.char)(header_name_ptr)
-				defer C.free(unsafe.Pointer(header_name))
-				header_value := *(**C.char)(header_value_ptr)
-				defer C.free(unsafe.Pointer(header_value))
-				arh.w.Header().Add(C.GoString(header_name), C.GoString(header_value))
-			}
-		}
+		addAsgiHeaders(arh.w.Header(), headers, "")
+		arh.trailers = uint8(trailers) == 1
 
 		arh.w.WriteHeader(int(status_code))
+		if arh.trailers {
+			// Headers have to be sent before the body is complete, otherwise net/http sets
+			// Content-Length instead of using chunked encoding and the trailers are dropped
+			if f, ok := arh.w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
 
 		runtime.LockOSThread()
-		C.AsgiEvent_set(event, nil)
+		C.AsgiEvent_set(event)
 		runtime.UnlockOSThread()
 	}}
 }
@@ -754,23 +3288,118 @@ func asgi_set_headers(request_id C.uint64_t, status_code C.int, headers *C.MapKe
 func asgi_send_response(request_id C.uint64_t, body *C.char, more_body C.uint8_t, event *C.AsgiEvent) {
 	asgi_lock.Lock()
 	defer asgi_lock.Unlock()
-	arh := asgi_handlers[uint64(request_id)]
+	arh, ok := asgi_handlers[uint64(request_id)]
+	if !ok {
+		// Request already finished, unblock the app
+		C.AsgiEvent_set(event)
+		return
+	}
 
 	arh.operations <- AsgiOperations{op: func() {
 		body_bytes := []byte(C.GoString(body))
 		_, err := arh.w.Write(body_bytes)
 		if err != nil {
 			arh.done <- err
-		} else if int(more_body) == 0 {
+		} else if int(more_body) == 0 && !arh.trailers {
+			arh.done <- nil
+		}
+
+		runtime.LockOSThread()
+		C.AsgiEvent_set(event)
+		runtime.UnlockOSThread()
+	}}
+}
+
+//export asgi_send_path
+func asgi_send_path(request_id C.uint64_t, path *C.char, event *C.AsgiEvent) {
+	asgi_lock.Lock()
+	defer asgi_lock.Unlock()
+	arh, ok := asgi_handlers[uint64(request_id)]
+	if !ok {
+		// Request already finished, unblock the app
+		C.AsgiEvent_set(event)
+		return
+	}
+
+	file_path := C.GoString(path)
+
+	arh.operations <- AsgiOperations{op: func() {
+		if !filepath.IsAbs(file_path) {
+			arh.done <- fmt.Errorf("pathsend expects an absolute path: %s", file_path)
+		} else if f, err := os.Open(file_path); err != nil {
+			arh.done <- err
+		} else {
+			// Copying from an *os.File lets the response writer use sendfile
+			_, err = io.Copy(arh.w, f)
+			f.Close()
+			arh.done <- err
+		}
+
+		runtime.LockOSThread()
+		C.AsgiEvent_set(event)
+		runtime.UnlockOSThread()
+	}}
+}
+
+//export asgi_send_early_hint
+func asgi_send_early_hint(request_id C.uint64_t, links *C.MapKeyVal, event *C.AsgiEvent) {
+	asgi_lock.Lock()
+	defer asgi_lock.Unlock()
+	arh, ok := asgi_handlers[uint64(request_id)]
+	if !ok {
+		// Request already finished, unblock the app
+		addAsgiHeaders(http.Header{}, links, "")
+		C.AsgiEvent_set(event)
+		return
+	}
+
+	arh.operations <- AsgiOperations{op: func() {
+		// Link headers are kept for the final response, which is allowed by RFC 8297
+		addAsgiHeaders(arh.w.Header(), links, "")
+		arh.w.WriteHeader(http.StatusEarlyHints)
+
+		runtime.LockOSThread()
+		C.AsgiEvent_set(event)
+		runtime.UnlockOSThread()
+	}}
+}
+
+//export asgi_send_trailers
+func asgi_send_trailers(request_id C.uint64_t, trailers *C.MapKeyVal, more_trailers C.uint8_t, event *C.AsgiEvent) {
+	asgi_lock.Lock()
+	defer asgi_lock.Unlock()
+	arh, ok := asgi_handlers[uint64(request_id)]
+	if !ok {
+		// Request already finished, unblock the app
+		addAsgiHeaders(http.Header{}, trailers, "")
+		C.AsgiEvent_set(event)
+		return
+	}
+
+	arh.operations <- AsgiOperations{op: func() {
+		// Trailers are sent by net/http when their names use the TrailerPrefix
+		addAsgiHeaders(arh.w.Header(), trailers, http.TrailerPrefix)
+		if int(more_trailers) == 0 {
 			arh.done <- nil
 		}
 
 		runtime.LockOSThread()
-		C.AsgiEvent_set(event, nil)
+		C.AsgiEvent_set(event)
 		runtime.UnlockOSThread()
 	}}
 }
 
+//export asgi_log
+func asgi_log(request_id C.uint64_t, message *C.char) {
+	logger := pythonLogger()
+	asgi_lock.RLock()
+	if arh, ok := asgi_handlers[uint64(request_id)]; ok {
+		logger = arh.logger
+	}
+	asgi_lock.RUnlock()
+	logger.Error(C.GoString(message))
+}
+
 //export asgi_cancel_request
 func asgi_cancel_request(request_id C.uint64_t) {
 	asgi_lock.Lock()
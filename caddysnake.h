@@ -6,37 +6,80 @@
 #include <stdlib.h>
 
 void Py_init_and_release_gil(const char *);
+int Py_minor_version(void);
+int Py_is_free_threaded(void);
+int Py_is_gil_enabled(void);
+int Py_detect_interface(const char *, const char *, const char *);
 
 typedef struct {
   size_t count;
   char **keys;
   char **values;
+  // Keys and values point into data, see MapKeyVal_new
+  char *data;
+  size_t data_size;
+  size_t data_used;
 } MapKeyVal;
-MapKeyVal *MapKeyVal_new(size_t);
+MapKeyVal *MapKeyVal_new(size_t, size_t);
+void MapKeyVal_set(MapKeyVal *, size_t, const char *, size_t, const char *,
+                   size_t);
+void MapKeyVal_free(MapKeyVal *);
+void Py_set_environ(MapKeyVal *);
+void Py_prepend_sys_path(const char *);
+MapKeyVal *Py_read_project_config(const char *);
+char *Py_dump_stacks(void);
+char *Py_memory_profile(const char *, const char *, int);
+int Py_health_check(const char *);
+int Py_shell(const char *, const char *, const char *);
 
 // WSGI Protocol
 typedef struct WsgiApp WsgiApp;
+typedef struct RequestResponse RequestResponse;
 WsgiApp *WsgiApp_import(const char *, const char *, const char *);
-void WsgiApp_handle_request(WsgiApp *, int64_t, MapKeyVal *, const char *);
+int WsgiApp_reload(WsgiApp *, const char *, const char *);
+RequestResponse *WsgiApp_handle_request(WsgiApp *, int64_t, MapKeyVal *);
+void RequestResponse_cancel(RequestResponse *);
+const char *RequestResponse_worker(RequestResponse *);
+void RequestResponse_cleanup(RequestResponse *);
 void WsgiApp_cleanup(WsgiApp *);
+void Wsgi_start_threads(int);
+long Wsgi_queue_depth(void);
 
-extern void wsgi_write_response(int64_t, int, MapKeyVal *, char *);
+extern int wsgi_write_response(int64_t, int, MapKeyVal *, char *, size_t,
+                               uint8_t);
+extern void wsgi_send_file(int64_t, int, MapKeyVal *, int, char *);
+extern int64_t wsgi_read_body(int64_t, char *, size_t);
+extern void wsgi_log(int64_t, char *);
+extern void python_log(int64_t, int, char *, char *, MapKeyVal *);
+extern void python_call_timing(char *, int64_t, int64_t);
 
 // ASGI 3.0 protocol
 
 typedef struct AsgiApp AsgiApp;
 typedef struct AsgiEvent AsgiEvent;
+uint8_t Asgi_start_event_loop(const char *, char *, size_t);
+void Asgi_set_executor_threads(int);
 AsgiApp *AsgiApp_import(const char *, const char *, const char *);
+int AsgiApp_reload(AsgiApp *, const char *, const char *);
 uint8_t AsgiApp_lifespan_startup(AsgiApp *);
 uint8_t AsgiApp_lifespan_shutdown(AsgiApp *);
-void AsgiApp_handle_request(AsgiApp *, uint64_t, MapKeyVal *, MapKeyVal *,
-                            const char *, int, const char *, int);
-void AsgiEvent_set(AsgiEvent *, const char *);
+AsgiEvent *AsgiApp_handle_request(AsgiApp *, uint64_t, MapKeyVal *,
+                                  MapKeyVal *, const char *, int, const char *,
+                                  int, MapKeyVal *);
+void AsgiEvent_set(AsgiEvent *);
+void AsgiEvent_set_receive(AsgiEvent *, const char *, size_t, uint8_t);
+void AsgiEvent_disconnect(AsgiEvent *);
+void AsgiEvent_cancel(AsgiEvent *);
+void AsgiEvent_cleanup(AsgiEvent *);
 void AsgiApp_cleanup(AsgiApp *);
 
 extern void asgi_receive_start(uint64_t, AsgiEvent *);
 extern void asgi_send_response(uint64_t, char *, uint8_t, AsgiEvent *);
-extern void asgi_set_headers(uint64_t, int, MapKeyVal *, AsgiEvent *);
+extern void asgi_set_headers(uint64_t, int, MapKeyVal *, uint8_t, AsgiEvent *);
+extern void asgi_send_path(uint64_t, char *, AsgiEvent *);
+extern void asgi_send_trailers(uint64_t, MapKeyVal *, uint8_t, AsgiEvent *);
+extern void asgi_send_early_hint(uint64_t, MapKeyVal *, AsgiEvent *);
 extern void asgi_cancel_request(uint64_t);
+extern void asgi_log(uint64_t, char *);
 
 #endif // CADDYSNAKE_H_
@@ -1,29 +1,431 @@
-def caddysnake_setup_wsgi(callback):
+def caddysnake_setup_logging(log, log_record):
+    import logging
+    import sys
+    import traceback
+    from contextvars import ContextVar
+    from io import TextIOBase
+    from threading import Lock
+
+    # WSGI request handled by the current thread, 0 when there's none
+    current_request_id = ContextVar("current_request_id", default=0)
+
+    class LogWriter(TextIOBase):
+        """Sends each line written to the Caddy logger."""
+
+        def __init__(self, request_id=None):
+            self.request_id = request_id
+            self.lock = Lock()
+            self.buffer = ""
+
+        def writable(self):
+            return True
+
+        def write(self, s):
+            with self.lock:
+                *lines, self.buffer = (self.buffer + s).split("\n")
+            for line in lines:
+                self.log(line)
+            return len(s)
+
+        def flush(self):
+            with self.lock:
+                line, self.buffer = self.buffer, ""
+            self.log(line)
+
+        def log(self, line):
+            if not line.strip():
+                return
+            request_id = self.request_id
+            if request_id is None:
+                request_id = current_request_id.get()
+            log(request_id, line)
+
+    # Attributes of every LogRecord, the rest are extras passed by the app
+    record_attrs = set(vars(logging.makeLogRecord({}))) | {"message", "asctime"}
+
+    class ZapHandler(logging.Handler):
+        """Sends log records to the Caddy logger as structured entries."""
+
+        def emit(self, record):
+            try:
+                message = self.format(record)
+                extras = [
+                    (key, str(value))
+                    for key, value in vars(record).items()
+                    if key not in record_attrs
+                ]
+                log_record(
+                    current_request_id.get(),
+                    record.levelno,
+                    record.name,
+                    message,
+                    extras,
+                )
+            except Exception:
+                self.handleError(record)
+
+    def format_exception(exc):
+        lines = traceback.format_exception(type(exc), exc, exc.__traceback__)
+        return "".join(lines).rstrip("\n")
+
+    sys.stderr = LogWriter()
+    logging.root.addHandler(ZapHandler())
+
+    return current_request_id, LogWriter, format_exception
+
+
+def caddysnake_setup_interface():
+    import inspect
+
+    def is_asgi_app(app):
+        """ASGI apps are coroutine functions or objects with an async __call__."""
+        if inspect.isclass(app):
+            return False
+        if not inspect.isroutine(app):
+            app = getattr(app, "__call__", None)
+        return inspect.iscoroutinefunction(app)
+
+    return is_asgi_app
+
+
+def caddysnake_setup_project():
+    def read_project_config(path):
+        """Returns the [tool.caddy-snake] table of a pyproject.toml as (key, value) pairs.
+        Variables of the env table are returned as env.NAME."""
+        try:
+            import tomllib
+        except ImportError:
+            # Python < 3.11
+            import tomli as tomllib
+
+        with open(path, "rb") as f:
+            config = tomllib.load(f).get("tool", {}).get("caddy-snake", {})
+        if not isinstance(config, dict):
+            raise ValueError("[tool.caddy-snake] must be a table")
+
+        def to_str(value):
+            if isinstance(value, bool):
+                return "on" if value else "off"
+            return str(value)
+
+        pairs = []
+        for key, value in config.items():
+            if key == "env":
+                if not isinstance(value, dict):
+                    raise ValueError("[tool.caddy-snake.env] must be a table")
+                pairs.extend((f"env.{name}", to_str(v)) for name, v in value.items())
+            else:
+                pairs.append((key, to_str(value)))
+        return pairs
+
+    return read_project_config
+
+
+def caddysnake_setup_reload():
+    import importlib
+    import sys
+
+    def reload_app(module_name, app_name):
+        """Imports the app again, dropping its top-level package from sys.modules first."""
+        package = module_name.partition(".")[0]
+        previous = {
+            name: module
+            for name, module in sys.modules.items()
+            if name == package or name.startswith(package + ".")
+        }
+        for name in previous:
+            del sys.modules[name]
+        importlib.invalidate_caches()
+        try:
+            app = getattr(importlib.import_module(module_name), app_name)
+            if not callable(app):
+                raise TypeError(f"{module_name}:{app_name} is not callable")
+            return app
+        except BaseException:
+            # Keep serving the modules that were loaded
+            for name in list(sys.modules):
+                if name == package or name.startswith(package + "."):
+                    del sys.modules[name]
+            sys.modules.update(previous)
+            raise
+
+    return reload_app
+
+
+def caddysnake_setup_debug():
+    import asyncio
+    import faulthandler
+    import io
+    import tempfile
+    import threading
+
+    def dump_stacks(loop):
+        """Returns the stacks of all Python threads and of the tasks running in loop."""
+        # faulthandler reads the frames without creating frame objects for
+        # threads that are running, which isn't safe with sys._current_frames
+        with tempfile.TemporaryFile(mode="w+") as out:
+            faulthandler.dump_traceback(out, all_threads=True)
+            out.seek(0)
+            stacks = out.read()
+        for thread in threading.enumerate():
+            header = f"Thread 0x{thread.ident:016x}"
+            stacks = stacks.replace(header, f"{header} [{thread.name}]")
+        lines = [stacks, "\n"]
+        if loop is not None:
+            # all_tasks isn't thread safe, the loop can change the set of tasks
+            for _ in range(10):
+                try:
+                    tasks = list(asyncio.all_tasks(loop))
+                    break
+                except RuntimeError:
+                    continue
+            else:
+                tasks = []
+            for task in tasks:
+                coro = task.get_coro()
+                if getattr(coro, "cr_running", False):
+                    # Already in the stack of the event loop thread
+                    continue
+                out = io.StringIO()
+                task.print_stack(file=out)
+                lines.append(out.getvalue())
+                lines.append("\n")
+        return "".join(lines)
+
+    return dump_stacks
+
+
+def caddysnake_setup_memory():
+    import json
+    import os
+    import sys
+    import tracemalloc
+
+    def app_files(module):
+        """Returns a pattern matching the source files of the package where module lives."""
+        package = module.split(":")[0].split(".")[0]
+        path = getattr(sys.modules.get(package), "__file__", None)
+        if not path:
+            return None
+        if os.path.basename(path) == "__init__.py":
+            return os.path.join(os.path.dirname(path), "*")
+        return path
+
+    def top_allocations(snapshot, limit):
+        allocations = []
+        for stat in snapshot.statistics("lineno")[:limit]:
+            frame = stat.traceback[0]
+            allocations.append(
+                {
+                    "file": frame.filename,
+                    "line": frame.lineno,
+                    "size": stat.size,
+                    "count": stat.count,
+                }
+            )
+        return allocations
+
+    def memory_profile(command, modules, limit):
+        """
+        Starts or stops tracing allocations, and returns the top allocation
+        sites overall and for each app as JSON.
+        """
+        if command == "start" and not tracemalloc.is_tracing():
+            tracemalloc.start()
+        elif command == "stop":
+            tracemalloc.stop()
+        result = {"tracing": tracemalloc.is_tracing()}
+        if command != "stats" or not result["tracing"]:
+            return json.dumps(result)
+        result["current"], result["peak"] = tracemalloc.get_traced_memory()
+        snapshot = tracemalloc.take_snapshot().filter_traces(
+            [tracemalloc.Filter(False, tracemalloc.__file__)]
+        )
+        result["top"] = top_allocations(snapshot, limit)
+        result["apps"] = []
+        for module in modules.split("\n") if modules else []:
+            files = app_files(module)
+            app_snapshot = snapshot.filter_traces([tracemalloc.Filter(True, files)])
+            result["apps"].append(
+                {
+                    "module": module,
+                    "top": top_allocations(app_snapshot, limit) if files else [],
+                }
+            )
+        return json.dumps(result)
+
+    return memory_profile
+
+
+def caddysnake_setup_health():
+    import importlib
+
+    def health_check(target):
+        """
+        Returns whether the app is healthy. The interpreter responding is enough
+        unless target names a callable, then its result must be truthy.
+        """
+        if not target:
+            return True
+        module_name, _, name = target.partition(":")
+        check = getattr(importlib.import_module(module_name), name)
+        return bool(check())
+
+    return health_check
+
+
+def caddysnake_setup_shell():
+    import code
+    import importlib
+    import sys
+    import traceback
+
+    def shell(command, target, packages_path):
+        """
+        Runs command, or an interactive console when it's None, with the app
+        named by target (module:app) imported as `app`. Returns the exit code.
+        """
+        if packages_path and packages_path not in sys.path:
+            sys.path.append(packages_path)
+        namespace = {"__name__": "__main__"}
+        # Tracebacks go to the terminal instead of the Caddy logger
+        log_writer, sys.stderr = sys.stderr, sys.__stderr__
+        try:
+            if target:
+                module_name, _, name = target.partition(":")
+                namespace["app"] = getattr(importlib.import_module(module_name), name)
+            if command is not None:
+                exec(compile(command, "<string>", "exec"), namespace)
+            else:
+                code.interact(local=namespace, exitmsg="")
+        except SystemExit as e:
+            if e.code is None or isinstance(e.code, int):
+                return e.code or 0
+            print(e.code, file=sys.stderr)
+            return 1
+        except BaseException:
+            traceback.print_exc()
+            return 1
+        finally:
+            sys.stderr = log_writer
+        return 0
+
+    return shell
+
+
+def caddysnake_setup_wsgi(callback, read_body):
+    from io import BufferedReader, RawIOBase
     from queue import SimpleQueue
-    from threading import Thread
+    from threading import Lock, Thread, current_thread
 
     task_queue = SimpleQueue()
+    threads = []
+    threads_lock = Lock()
+
+    class WsgiInput(RawIOBase):
+        """Reads the request body from Go as the app consumes it."""
+
+        def __init__(self, request_id):
+            self.request_id = request_id
+
+        def readable(self):
+            return True
+
+        def readinto(self, b):
+            return read_body(self.request_id, b)
+
+    def build_wsgi_input(request_id):
+        return BufferedReader(WsgiInput(request_id), 64 * 1024)
+
+    class FileWrapper:
+        """wsgi.file_wrapper, files are served by Go with sendfile when possible."""
+
+        def __init__(self, filelike, block_size=8192):
+            self.filelike = filelike
+            self.block_size = block_size
+            if hasattr(filelike, "close"):
+                self.close = filelike.close
+
+        def __iter__(self):
+            return self
 
-    def process_request_response(task):
+        def __next__(self):
+            data = self.filelike.read(self.block_size)
+            if data:
+                return data
+            raise StopIteration
+
+    def process_request_response(task, worker):
         try:
-            task.call_wsgi()
+            task.call_wsgi(worker)
             callback(task, None)
         except Exception as e:
             callback(task, e)
 
     def worker():
+        name = current_thread().name
         while True:
             task = task_queue.get()
-            Thread(target=process_request_response, args=(task,)).start()
+            process_request_response(task, name)
 
-    Thread(target=worker).start()
+    def start_threads(count):
+        """Grows the pool of threads that run WSGI requests up to count."""
+        with threads_lock:
+            while len(threads) < count:
+                thread = Thread(target=worker, name=f"caddysnake-wsgi-{len(threads)}")
+                thread.start()
+                threads.append(thread)
 
-    return task_queue
+    return task_queue, build_wsgi_input, FileWrapper, start_threads
 
 
-def caddysnake_setup_asgi(loop):
+def caddysnake_setup_asgi():
     import asyncio
-    from threading import Thread
+    import sys
+    from concurrent.futures import ThreadPoolExecutor
+    from threading import Lock, Thread
+
+    loop = None
+    loop_kind = None
+    loop_lock = Lock()
+    executor = None
+    executor_threads = 0
+
+    def new_event_loop(event_loop):
+        if event_loop in ("auto", "uvloop"):
+            try:
+                import uvloop
+            except ImportError:
+                if event_loop == "uvloop":
+                    raise
+            else:
+                asyncio.set_event_loop_policy(uvloop.EventLoopPolicy())
+                return asyncio.new_event_loop(), "uvloop"
+        return asyncio.new_event_loop(), "asyncio"
+
+    def start_event_loop(event_loop):
+        """Starts the loop shared by all ASGI apps the first time it's called.
+        Returns the loop and its kind, which can differ from event_loop when it
+        was already running."""
+        nonlocal loop, loop_kind
+        with loop_lock:
+            if loop is None:
+                loop, loop_kind = new_event_loop(event_loop)
+                Thread(target=loop.run_forever, name="caddysnake-asgi-loop").start()
+            return loop, loop_kind
+
+    def set_executor_threads(count):
+        """Grows the default executor of the loop to count threads."""
+        nonlocal executor, executor_threads
+        with loop_lock:
+            if count <= executor_threads:
+                return
+            previous = executor
+            executor_threads = count
+            executor = ThreadPoolExecutor(count, thread_name_prefix="caddysnake-asgi")
+            loop.call_soon_threadsafe(loop.set_default_executor, executor)
+            if previous is not None:
+                previous.shutdown(wait=False)
 
     # See: https://stackoverflow.com/questions/33000200/asyncio-wait-for-event-from-other-thread
     class Event_ts(asyncio.Event):
@@ -33,8 +435,8 @@ def caddysnake_setup_asgi(loop):
     def build_receive(asgi_event):
         async def receive():
             asgi_event.receive_start()
-            await asgi_event.wait()
-            asgi_event.clear()
+            await asgi_event.receive_wait()
+            asgi_event.receive_clear()
             return asgi_event.receive_end()
 
         return receive
@@ -116,6 +518,11 @@ def caddysnake_setup_asgi(loop):
 
         return lifespan_startup, lifespan_shutdown
 
-    Thread(target=loop.run_forever).start()
-
-    return Event_ts, build_receive, build_send, build_lifespan
+    return (
+        Event_ts,
+        build_receive,
+        build_send,
+        build_lifespan,
+        start_event_loop,
+        set_executor_threads,
+    )
@@ -1,11 +1,22 @@
 from typing import Callable
 import json
+import time
 import wsgiref.validate
 
 db = {}
 
 CHUNK_SIZE = 256 * 2**20
 
+# Changes every time the module is imported, to check reloads
+IMPORTED_AT = str(time.time_ns())
+
+# Returned by the health check, toggled with /healthz/toggle
+READY = True
+
+
+def is_ready():
+    return READY
+
 
 def store_item(id: str, content: dict):
     db[id] = content
@@ -51,6 +62,39 @@ def app(environ: dict, start_response: Callable):
         response_headers = [("Content-Type", content_type)]
         start_response(status, response_headers)
         yield body
+    elif path == "/cookies":
+        start_response(
+            "200 OK",
+            [
+                ("Content-Type", "text/plain"),
+                ("Set-Cookie", "first=1; Path=/"),
+                ("Set-Cookie", "second=2; Path=/"),
+            ],
+        )
+        yield b"Cookies"
+    elif path == "/slow":
+        # Short sleeps let the TimeoutError raised by the timeout interrupt the loop
+        for _ in range(100):
+            time.sleep(0.1)
+        start_response("200 OK", [("Content-Type", "text/plain")])
+        yield b"Too late"
+    elif path == "/healthz/toggle":
+        global READY
+        READY = not READY
+        start_response("200 OK", [("Content-Type", "text/plain")])
+        yield str(READY).encode()
+    elif path == "/imported-at":
+        start_response("200 OK", [("Content-Type", "text/plain")])
+        yield IMPORTED_AT.encode()
+    elif path in ("/remote", "/proxied"):
+        start_response("200 OK", [("Content-Type", "application/json")])
+        yield json.dumps(
+            {
+                "remote_addr": environ.get("REMOTE_ADDR"),
+                "remote_port": environ.get("REMOTE_PORT"),
+                "url_scheme": environ["wsgi.url_scheme"],
+            }
+        ).encode()
     else:
         start_response("404 Not Found", [("Content-type", "text/plain")])
         yield b"Not found"
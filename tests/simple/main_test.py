@@ -9,6 +9,8 @@ item_count = 0
 
 BASE_URL = "http://localhost:9080"
 
+ADMIN_URL = "http://localhost:2019"
+
 BIG_BLOB = base64.b64encode(os.urandom(4 * 2**20)).decode("utf")
 
 
@@ -46,6 +48,97 @@ def item_lifecycle():
     assert not delete_item(id), "Delete item should fail"
 
 
+def check_cookies():
+    response = requests.get(f"{BASE_URL}/cookies")
+    assert response.status_code == 200, "Cookies request failed"
+    assert response.raw.headers.getlist("Set-Cookie") == [
+        "first=1; Path=/",
+        "second=2; Path=/",
+    ], "Expected two separate Set-Cookie headers"
+
+
+def check_timeout():
+    start = time.time()
+    response = requests.get(f"{BASE_URL}/slow")
+    assert response.status_code == 504, "Expected gateway timeout"
+    assert time.time() - start < 5, "Expected request to be cut at the timeout"
+
+
+def check_remote_addr():
+    response = requests.get(
+        f"{BASE_URL}/remote", headers={"X-Forwarded-For": "203.0.113.7"}
+    )
+    assert response.status_code == 200, "Remote request failed"
+    remote = response.json()
+    assert remote["remote_addr"] in ("127.0.0.1", "::1"), "Expected the direct peer"
+    assert remote["remote_port"].isdigit(), "Expected the peer port"
+
+
+def check_trusted_proxies():
+    response = requests.get(
+        f"{BASE_URL}/proxied",
+        headers={
+            "X-Forwarded-For": "203.0.113.7, 127.0.0.1",
+            "X-Forwarded-Proto": "https",
+        },
+    )
+    assert response.status_code == 200, "Proxied request failed"
+    remote = response.json()
+    assert remote["remote_addr"] == "203.0.113.7", "Expected the forwarded client"
+    assert remote["url_scheme"] == "https", "Expected the forwarded scheme"
+
+
+def get_admin_app(module: str) -> dict:
+    response = requests.get(f"{ADMIN_URL}/python/apps")
+    assert response.status_code == 200, "Listing apps failed"
+    apps = [app for app in response.json() if app["module"] == module]
+    assert len(apps) == 1, f"Expected {module} to be listed once"
+    return apps[0]
+
+
+def check_admin_apps():
+    app = get_admin_app("main:app")
+    assert app["interface"] == "wsgi", "Expected a WSGI app"
+    assert app["requests"] > 0, "Expected requests to be counted"
+    assert app["errors"] > 0, "Expected the timed out request to be counted"
+
+
+def check_admin_reload():
+    imported_at = requests.get(f"{BASE_URL}/imported-at").text
+    reloads = get_admin_app("main:app")["reloads"]
+    response = requests.post(f"{ADMIN_URL}/python/apps/main:app/reload")
+    assert response.status_code == 200, "Reload failed"
+    assert response.json()["reloads"] == reloads + 1, "Expected reload to be counted"
+    response = requests.get(f"{BASE_URL}/imported-at")
+    assert response.status_code == 200, "Request after reload failed"
+    assert response.text != imported_at, "Expected the module to be imported again"
+    response = requests.post(f"{ADMIN_URL}/python/apps/missing:app/reload")
+    assert response.status_code == 404, "Expected unknown app to be not found"
+
+
+def check_health():
+    response = requests.get(f"{BASE_URL}/healthz/live")
+    assert response.status_code == 200, "Expected the interpreter to be live"
+    response = requests.get(f"{BASE_URL}/healthz/ready")
+    assert response.status_code == 200, "Expected the app to be ready"
+    assert requests.get(f"{BASE_URL}/healthz/toggle").text == "False"
+    response = requests.get(f"{BASE_URL}/healthz/ready")
+    assert response.status_code == 503, "Expected the app not to be ready"
+    response = requests.get(f"{BASE_URL}/healthz/live")
+    assert response.status_code == 200, "Expected liveness to skip the health check"
+    assert requests.get(f"{BASE_URL}/healthz/toggle").text == "True"
+
+
+def check_config_reload():
+    config = requests.get(f"{ADMIN_URL}/config/").json()
+    response = requests.post(
+        f"{ADMIN_URL}/load", json=config, headers={"Cache-Control": "must-revalidate"}
+    )
+    assert response.status_code == 200, "Config reload failed"
+    check_cookies()
+    item_lifecycle()
+
+
 def make_objects(max_workers: int, count: int):
     start = time.time()
     failed = False
@@ -71,4 +164,12 @@ def make_objects(max_workers: int, count: int):
 
 
 if __name__ == "__main__":
+    check_cookies()
+    check_timeout()
+    check_remote_addr()
+    check_trusted_proxies()
+    check_admin_apps()
+    check_admin_reload()
+    check_health()
+    check_config_reload()
     make_objects(max_workers=4, count=2_500)
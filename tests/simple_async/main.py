@@ -1,4 +1,6 @@
+import asyncio
 import json
+import os
 
 db = {}
 
@@ -48,6 +50,87 @@ async def app(scope, receive, send):
             }
         )
         await send({"type": "http.response.body", "body": body})
+    elif path == "/cookies":
+        await send(
+            {
+                "type": "http.response.start",
+                "status": 200,
+                "headers": [
+                    (b"Content-Type", b"text/plain"),
+                    (b"Set-Cookie", b"first=1; Path=/"),
+                    (b"Set-Cookie", b"second=2; Path=/"),
+                ],
+            }
+        )
+        await send({"type": "http.response.body", "body": b"Cookies"})
+    elif path == "/pathsend":
+        await send(
+            {
+                "type": "http.response.start",
+                "status": 200,
+                "headers": [(b"Content-Type", b"text/plain")],
+            }
+        )
+        await send(
+            {"type": "http.response.pathsend", "path": os.path.abspath(__file__)}
+        )
+    elif path == "/trailers":
+        await send(
+            {
+                "type": "http.response.start",
+                "status": 200,
+                "headers": [(b"Content-Type", b"text/plain")],
+                "trailers": True,
+            }
+        )
+        await send({"type": "http.response.body", "body": b"Trailers"})
+        await send(
+            {
+                "type": "http.response.trailers",
+                "headers": [(b"Grpc-Status", b"0")],
+                "more_trailers": False,
+            }
+        )
+    elif path == "/early-hints":
+        await send(
+            {
+                "type": "http.response.early_hint",
+                "links": [b"</style.css>; rel=preload; as=style"],
+            }
+        )
+        await send(
+            {
+                "type": "http.response.start",
+                "status": 200,
+                "headers": [(b"Content-Type", b"text/plain")],
+            }
+        )
+        await send({"type": "http.response.body", "body": b"Early hints"})
+    elif path == "/slow":
+        await asyncio.sleep(10)
+        await send(
+            {
+                "type": "http.response.start",
+                "status": 200,
+                "headers": [(b"Content-Type", b"text/plain")],
+            }
+        )
+        await send({"type": "http.response.body", "body": b"Too late"})
+    elif path == "/upload":
+        size = 0
+        more_body = True
+        while more_body:
+            message = await receive()
+            size += len(message.get("body", b""))
+            more_body = message.get("more_body", False)
+        await send(
+            {
+                "type": "http.response.start",
+                "status": 200,
+                "headers": [(b"Content-Type", b"text/plain")],
+            }
+        )
+        await send({"type": "http.response.body", "body": str(size).encode()})
     else:
         await send(
             {
@@ -57,3 +140,46 @@ async def app(scope, receive, send):
             }
         )
         await send({"type": "http.response.body", "body": b"Not Found"})
+
+
+async def state_app(scope, receive, send):
+    if scope["type"] == "lifespan":
+        while True:
+            message = await receive()
+            if message["type"] == "lifespan.startup":
+                scope["state"]["greeting"] = "Hello from lifespan"
+                await send({"type": "lifespan.startup.complete"})
+            elif message["type"] == "lifespan.shutdown":
+                await send({"type": "lifespan.shutdown.complete"})
+                return
+    await send(
+        {
+            "type": "http.response.start",
+            "status": 200,
+            "headers": [(b"Content-Type", b"text/plain")],
+        }
+    )
+    greeting = scope["state"].get("greeting", "No state")
+    await send({"type": "http.response.body", "body": greeting.encode()})
+
+
+def echo(name: str):
+    """Returns an app that responds with its name and where it's mounted."""
+
+    async def echo_app(scope, receive, send):
+        await send(
+            {
+                "type": "http.response.start",
+                "status": 200,
+                "headers": [(b"Content-Type", b"application/json")],
+            }
+        )
+        body = {"app": name, "root_path": scope["root_path"], "path": scope["path"]}
+        await send({"type": "http.response.body", "body": json.dumps(body).encode()})
+
+    return echo_app
+
+
+api_app = echo("api")
+admin_app = echo("admin")
+default_app = echo("default")
@@ -1,4 +1,5 @@
 import os
+import socket
 import base64
 import uuid
 import time
@@ -9,6 +10,8 @@ item_count = 0
 
 BASE_URL = "http://localhost:9080"
 
+ADMIN_URL = "http://localhost:2019"
+
 BIG_BLOB = base64.b64encode(os.urandom(4 * 2**20)).decode("utf")
 
 
@@ -46,6 +49,117 @@ def item_lifecycle():
     assert not delete_item(id), "Delete item should fail"
 
 
+def check_lifespan_state():
+    response = requests.get(f"{BASE_URL}/state")
+    assert response.status_code == 200, "State request failed"
+    assert response.text == "Hello from lifespan", "Expected state set in lifespan"
+
+
+def check_cookies():
+    response = requests.get(f"{BASE_URL}/cookies")
+    assert response.status_code == 200, "Cookies request failed"
+    assert response.raw.headers.getlist("Set-Cookie") == [
+        "first=1; Path=/",
+        "second=2; Path=/",
+    ], "Expected two separate Set-Cookie headers"
+
+
+def check_pathsend():
+    response = requests.get(f"{BASE_URL}/pathsend")
+    assert response.status_code == 200, "Pathsend request failed"
+    with open("main.py", "rb") as f:
+        assert response.content == f.read(), "Expected the content of main.py"
+
+
+def raw_get(path: str) -> bytes:
+    """Returns the raw response, including trailers and informational responses."""
+    request = (
+        f"GET {path} HTTP/1.1\r\n"
+        "Host: localhost:9080\r\n"
+        "TE: trailers\r\n"
+        "Connection: close\r\n\r\n"
+    )
+    with socket.create_connection(("localhost", 9080)) as sock:
+        sock.sendall(request.encode())
+        response = b""
+        while chunk := sock.recv(4096):
+            response += chunk
+        return response
+
+
+def check_trailers():
+    response = raw_get("/trailers")
+    assert response.startswith(b"HTTP/1.1 200"), "Trailers request failed"
+    assert response.endswith(
+        b"0\r\nGrpc-Status: 0\r\n\r\n"
+    ), "Expected trailer after body"
+
+
+def check_early_hints():
+    response = raw_get("/early-hints")
+    assert response.startswith(b"HTTP/1.1 103 Early Hints\r\n"), "Expected 103 first"
+    assert (
+        b"Link: </style.css>; rel=preload; as=style" in response
+    ), "Expected Link header"
+    assert b"HTTP/1.1 200 OK\r\n" in response, "Expected final response"
+    assert response.endswith(b"Early hints"), "Expected body"
+
+
+def check_timeout():
+    start = time.time()
+    response = requests.get(f"{BASE_URL}/slow")
+    assert response.status_code == 504, "Expected gateway timeout"
+    assert time.time() - start < 5, "Expected request to be cut at the timeout"
+
+
+def check_max_request_body():
+    response = requests.post(f"{BASE_URL}/upload", data=b"x" * 1000)
+    assert response.status_code == 200, "Upload request failed"
+    assert response.text == "1000", "Expected the whole body"
+    response = requests.post(f"{BASE_URL}/upload", data=b"x" * 2000)
+    assert response.status_code == 413, "Expected request entity too large"
+
+
+def check_mounts():
+    response = requests.get(f"{BASE_URL}/mounted/api/hello")
+    assert response.status_code == 200, "Mounted api request failed"
+    assert response.json() == {
+        "app": "api",
+        "root_path": "/mounted/api",
+        "path": "/hello",
+    }, "Expected the api app"
+    response = requests.get(f"{BASE_URL}/mounted/admin/users")
+    assert response.status_code == 200, "Mounted admin request failed"
+    assert response.json() == {
+        "app": "admin",
+        "root_path": "/mounted/admin",
+        "path": "/users",
+    }, "Expected the admin app"
+    response = requests.get(f"{BASE_URL}/mounted/other")
+    assert response.content == b"", "Expected no app to handle the request"
+
+
+def check_hosts():
+    for host, app in [
+        ("tenant1.example.com", "api"),
+        ("shop.example.org", "admin"),
+        ("other.example.com", "default"),
+    ]:
+        response = requests.get(f"{BASE_URL}/hello", headers={"Host": f"{host}:9080"})
+        assert response.status_code == 200, f"Request to {host} failed"
+        assert response.json()["app"] == app, f"Expected the {app} app for {host}"
+
+
+def check_config_reload():
+    config = requests.get(f"{ADMIN_URL}/config/").json()
+    response = requests.post(
+        f"{ADMIN_URL}/load", json=config, headers={"Cache-Control": "must-revalidate"}
+    )
+    assert response.status_code == 200, "Config reload failed"
+    check_lifespan_state()
+    item_lifecycle()
+
+
 def make_objects(max_workers: int, count: int):
     start = time.time()
     failed = False
@@ -71,4 +185,14 @@ def make_objects(max_workers: int, count: int):
 
 
 if __name__ == "__main__":
+    check_lifespan_state()
+    check_cookies()
+    check_pathsend()
+    check_trailers()
+    check_early_hints()
+    check_timeout()
+    check_max_request_body()
+    check_mounts()
+    check_hosts()
+    check_config_reload()
     make_objects(max_workers=4, count=2_500)